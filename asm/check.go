@@ -0,0 +1,144 @@
+package asm
+
+import (
+	"errors"
+	"io"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+// Check assembles src as Assemble does, but rather than stopping at the first
+// error it returns every error and warning found, sorted by position.
+func Check(src io.Reader, opts Options) Diagnostics {
+	p := NewParser(NewLexer(src))
+	p.files[0] = opts.File
+	p.Parse()
+	p.Compile()
+	return p.Diagnostics()
+}
+
+// Diagnostics returns the errors and warnings found so far, sorted by
+// position.
+func (p *Parser) Diagnostics() Diagnostics {
+	ds := append(Diagnostics(nil), p.diags...)
+	ds.sort()
+	return ds
+}
+
+// report records err, which occurred in the file being parsed.
+func (p *Parser) report(err error) {
+	var d *Diagnostic
+	if !errors.As(err, &d) {
+		d = &Diagnostic{Msg: err.Error()}
+	}
+	if d.File == "" {
+		d.File = p.files[p.file]
+	}
+	p.diags = append(p.diags, d)
+}
+
+// add records a diagnostic at a position in file.
+func (p *Parser) add(s Severity, file, line, col int, format string, args ...interface{}) {
+	d := errorAt(line, col, format, args...)
+	d.Severity, d.File = s, p.files[file]
+	p.diags = append(p.diags, d)
+}
+
+// annotate gives each diagnostic the text of the line it refers to.
+func (p *Parser) annotate() {
+	for _, d := range p.diags {
+		if d.Source != "" || d.Line < 1 {
+			continue
+		}
+		for i, name := range p.files {
+			if name == d.File {
+				d.Source = sourceLine(p.lexers[i].Source(), d.Line)
+				break
+			}
+		}
+	}
+}
+
+// checkRefs reports branches to labels and uses of vars that the source
+// does not define.
+func (p *Parser) checkRefs() {
+	for _, ins := range p.instructions {
+		switch arg := ins.arg.(type) {
+		case string:
+			if ins.op == pseudoInstructionLabel {
+				continue
+			}
+			if isJump(ins.op) || ins.op == bytecode.OpCall {
+				if !p.defined[arg] {
+					p.add(SeverityError, ins.file, ins.line, ins.pos, "undefined label %s", arg)
+				}
+			} else if _, ok := p.vars[arg]; !ok {
+				p.add(SeverityError, ins.file, ins.line, ins.pos, "undefined var %s", arg)
+			}
+		case [2]string:
+			for _, name := range arg {
+				if _, ok := p.vars[name]; !ok {
+					p.add(SeverityError, ins.file, ins.line, ins.pos, "undefined var %s", name)
+				}
+			}
+		}
+	}
+}
+
+// checkExports reports names given to .export that are neither labels nor
+// vars.
+func (p *Parser) checkExports() {
+	for _, e := range p.exports {
+		if _, ok := p.vars[e.name.Value]; !ok && !p.defined[e.name.Value] {
+			p.add(SeverityError, e.file, e.name.Line, e.name.Pos, "cannot export %s, no such label or var", e.name.Value)
+		}
+	}
+}
+
+// lint warns about labels and vars that are never used, other than main and
+// those exported, and about instructions that follow an unconditional jump,
+// halt or ret without a label, which can never execute.
+func (p *Parser) lint() {
+	labels := map[string]bool{"main": true}
+	vars := make(map[string]bool)
+	for _, e := range p.exports {
+		labels[e.name.Value], vars[e.name.Value] = true, true
+	}
+	for _, ins := range p.instructions {
+		switch arg := ins.arg.(type) {
+		case string:
+			if isJump(ins.op) || ins.op == bytecode.OpCall {
+				labels[arg] = true
+			} else if ins.op != pseudoInstructionLabel {
+				vars[arg] = true
+			}
+		case [2]string:
+			vars[arg[0]], vars[arg[1]] = true, true
+		}
+	}
+	for _, ins := range p.instructions {
+		if name, ok := ins.arg.(string); ok && ins.op == pseudoInstructionLabel && !labels[name] {
+			p.add(SeverityWarning, ins.file, ins.line, ins.pos, "label %s is never used", name)
+		}
+	}
+	for _, d := range p.decls {
+		if !vars[d.name.Value] {
+			p.add(SeverityWarning, d.file, d.name.Line, d.name.Pos, "var %s is never used", d.name.Value)
+		}
+	}
+	terminated, warned := false, false
+	for _, ins := range p.instructions {
+		if ins.op == pseudoInstructionLabel {
+			terminated, warned = false, false
+			continue
+		}
+		if terminated && !warned {
+			p.add(SeverityWarning, ins.file, ins.line, ins.pos, "unreachable code")
+			warned = true
+		}
+		switch ins.op {
+		case bytecode.OpJump, bytecode.OpHalt, bytecode.OpRet:
+			terminated = true
+		}
+	}
+}
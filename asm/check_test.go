@@ -0,0 +1,93 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	for i, tt := range []struct {
+		src      string
+		expected []string
+	}{
+		{":main\n\thalt\n", nil},
+		{
+			":main\n\tfrob\n\tpush_uint8 300\n\tpush_int64\n\thalt\n",
+			[]string{
+				"x.asm: invalid instruction at line 2 pos 2",
+				"x.asm: invalid uint8 at line 3 pos 2",
+				"x.asm: invalid int64 at line 4 pos 2",
+			},
+		},
+		{
+			":main\n\tload x\n\tmov x y\n\tjump nowhere\n",
+			[]string{
+				"x.asm: undefined var x at line 2 pos 2",
+				"x.asm: undefined var x at line 3 pos 2",
+				"x.asm: undefined var y at line 3 pos 2",
+				"x.asm: undefined label nowhere at line 4 pos 2",
+			},
+		},
+		{
+			"\"open\n:main\n\t@\n\thalt\n",
+			[]string{
+				"x.asm: unterminated string literal at line 1 pos 1",
+				"x.asm: unexpected character '@' at line 3 pos 2",
+			},
+		},
+		{":main\n:main\n\thalt\n", []string{"x.asm: label main already defined at line 2 pos 1"}},
+		{".export f\n:main\n\thalt\n", []string{"x.asm: cannot export f, no such label or var at line 1 pos 9"}},
+		{
+			"var a\nvar b\n.export b\n:main\n\tcall f\n\thalt\n\tdup\n\tprint\n:f\n\tret\n:g\n\tjump main\n\tnop\n",
+			[]string{
+				"x.asm: var a is never used at line 1 pos 5",
+				"x.asm: unreachable code at line 7 pos 2",
+				"x.asm: label g is never used at line 11 pos 1",
+				"x.asm: unreachable code at line 13 pos 2",
+			},
+		},
+	} {
+		var got []string
+		for _, d := range Check(strings.NewReader(tt.src), Options{File: "x.asm"}) {
+			got = append(got, d.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("%d. expecting diagnostics:\n%s\ngot:\n%s", i, strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+func TestCheckSeverity(t *testing.T) {
+	ds := Check(strings.NewReader("var a\n:main\n\tfrob\n\thalt\n"), Options{})
+	if len(ds.Errors()) != 1 || len(ds.Warnings()) != 1 {
+		t.Fatalf("expecting one error and one warning, got %v", ds)
+	}
+	if err := ds.Err(); err == nil || err.Error() != "invalid instruction at line 3 pos 2" {
+		t.Errorf("expecting only the error to be returned by Err, got %v", err)
+	}
+	if _, err := Assemble(strings.NewReader("var a\n:main\n\thalt\n"), Options{}); err != nil {
+		t.Errorf("expecting warnings not to fail assembly, got %v", err)
+	}
+	_, err := Assemble(strings.NewReader(":main\n\tfrob\n\tfrob\n\tfrob\n"), Options{})
+	if expected := "invalid instruction at line 2 pos 2 (and 2 more errors)"; err == nil || err.Error() != expected {
+		t.Errorf("expecting error %q, got %v", expected, err)
+	}
+}
+
+func TestDiagnosticsWriteTo(t *testing.T) {
+	ds := Check(strings.NewReader("var a\n:main\n\tpush_int64 1 frob\n\thalt\n"), Options{File: "x.asm"})
+	var buf bytes.Buffer
+	if _, err := ds.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "x.asm:1:5: warning: var a is never used\n" +
+		"var a\n" +
+		"    ^\n" +
+		"x.asm:3:15: error: invalid instruction\n" +
+		"\tpush_int64 1 frob\n" +
+		"\t             ^\n"
+	if buf.String() != expected {
+		t.Errorf("expecting:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
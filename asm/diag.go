@@ -0,0 +1,158 @@
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Severity is how serious a Diagnostic is.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is an error or warning about the source.
+type Diagnostic struct {
+	Severity Severity
+	File     string
+	Line     int // 0 if the diagnostic has no position
+	Col      int
+	Msg      string
+	Source   string // text of the line at Line, if known
+}
+
+// errorAt returns an error at a position in the source.
+func errorAt(line, col int, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *Diagnostic) Error() string {
+	s := d.Msg
+	if d.Line > 0 {
+		s = fmt.Sprintf("%s at line %d pos %d", s, d.Line, d.Col)
+	}
+	if d.File != "" {
+		s = d.File + ": " + s
+	}
+	return s
+}
+
+// Diagnostics is a list of diagnostics. As an error, it describes its first
+// entry and the number of others.
+type Diagnostics []*Diagnostic
+
+func (ds Diagnostics) Error() string {
+	switch len(ds) {
+	case 0:
+		return "no errors"
+	case 1:
+		return ds[0].Error()
+	case 2:
+		return ds[0].Error() + " (and 1 more error)"
+	}
+	return fmt.Sprintf("%s (and %d more errors)", ds[0].Error(), len(ds)-1)
+}
+
+// Errors returns the diagnostics with SeverityError.
+func (ds Diagnostics) Errors() Diagnostics { return ds.filter(SeverityError) }
+
+// Warnings returns the diagnostics with SeverityWarning.
+func (ds Diagnostics) Warnings() Diagnostics { return ds.filter(SeverityWarning) }
+
+func (ds Diagnostics) filter(s Severity) Diagnostics {
+	var out Diagnostics
+	for _, d := range ds {
+		if d.Severity == s {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Err returns the errors in ds as an error, or nil if there are none.
+func (ds Diagnostics) Err() error {
+	if errs := ds.Errors(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// sort orders ds by position, keeping files in the order they first appear.
+func (ds Diagnostics) sort() {
+	rank := make(map[string]int)
+	for _, d := range ds {
+		if _, ok := rank[d.File]; !ok {
+			rank[d.File] = len(rank)
+		}
+	}
+	sort.SliceStable(ds, func(i, j int) bool {
+		a, b := ds[i], ds[j]
+		if a.File != b.File {
+			return rank[a.File] < rank[b.File]
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+}
+
+// WriteTo writes each diagnostic as file:line:col: severity: message,
+// followed by the source line with a caret under the column, if known.
+func (ds Diagnostics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, d := range ds {
+		var pos []string
+		if d.File != "" {
+			pos = append(pos, d.File)
+		}
+		if d.Line > 0 {
+			pos = append(pos, fmt.Sprint(d.Line), fmt.Sprint(d.Col))
+		}
+		if len(pos) > 0 {
+			buf.WriteString(strings.Join(pos, ":") + ": ")
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", d.Severity, d.Msg)
+		if d.Source == "" || d.Col < 1 {
+			continue
+		}
+		buf.WriteString(d.Source + "\n")
+		// Keep tabs so the caret lines up however tabs are displayed.
+		for i, ch := range []rune(d.Source) {
+			if i >= d.Col-1 {
+				break
+			}
+			if ch == '\t' {
+				buf.WriteByte('\t')
+			} else {
+				buf.WriteByte(' ')
+			}
+		}
+		buf.WriteString("^\n")
+	}
+	return buf.WriteTo(w)
+}
+
+// sourceLine returns line n of src, counting from 1.
+func sourceLine(src []byte, n int) string {
+	sc := bufio.NewScanner(bytes.NewReader(src))
+	for i := 1; sc.Scan(); i++ {
+		if i == n {
+			return strings.TrimRight(sc.Text(), "\r")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package asm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+// maxLocals is the largest frame the machine will allocate.
+const maxLocals = 1 << 16
+
+func (p *Parser) parseDirective(itm Item) error {
+	switch itm.Value {
+	case ".const":
+		return p.parseConst(itm)
+	case ".macro":
+		return p.parseMacro(itm)
+	case ".endm":
+		return errorAt(itm.Line, itm.Pos, ".endm without .macro")
+	case ".include":
+		return p.parseInclude(itm)
+	case ".func":
+		return p.parseFunc(itm)
+	case ".export":
+		name, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		if name.Type != ItemIdentifier {
+			return errorAt(name.Line, name.Pos, "expecting label or var name")
+		}
+		p.exports = append(p.exports, symbol{name, p.file})
+		return nil
+	}
+	return errorAt(itm.Line, itm.Pos, "unknown directive %s", itm.Value)
+}
+
+// parseInclude parses `.include "file.asm"` and continues lexing from the
+// named file, which is found relative to the directory of the including
+// file. Lexing resumes after the directive once the file ends.
+func (p *Parser) parseInclude(itm Item) error {
+	name, err := p.next(itm)
+	if err != nil {
+		return err
+	}
+	if name.Type != ItemStringLit {
+		return errorAt(name.Line, name.Pos, "expecting file name")
+	}
+	if len(p.pending) > 0 {
+		return errorAt(itm.Line, itm.Pos, "include inside a macro expansion")
+	}
+	path := name.Value
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(p.files[p.file]), path)
+	}
+	chain := []string{p.files[p.file]}
+	for i := len(p.includes) - 1; i >= 0; i-- {
+		chain = append([]string{p.files[p.includes[i].file]}, chain...)
+	}
+	for i, open := range chain {
+		if sameFile(open, path) {
+			return errorAt(itm.Line, itm.Pos, "include cycle %s", strings.Join(append(chain[i:], path), " -> "))
+		}
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errorAt(itm.Line, itm.Pos, "%v", err)
+	}
+	p.includes = append(p.includes, include{p.lex, p.file})
+	p.files = append(p.files, path)
+	p.lexers = append(p.lexers, NewLexer(bytes.NewReader(src)))
+	p.lex, p.file = p.lexers[len(p.lexers)-1], len(p.files)-1
+	return nil
+}
+
+func sameFile(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// function is the frame layout declared by .func.
+type function struct {
+	name         string
+	args, locals int
+}
+
+// parseFunc parses `.func name args=N locals=M`, which defines the label
+// name followed by an enter instruction giving the function's frame N
+// arguments and M further locals. Either setting may be omitted, in which case
+// it is zero, and N and M may be constants. Until the next .func, load_local
+// and store_local are checked against the frame.
+func (p *Parser) parseFunc(itm Item) error {
+	name, err := p.next(itm)
+	if err != nil {
+		return err
+	}
+	if name.Type != ItemIdentifier || !sameLine(name, itm) {
+		return errorAt(itm.Line, itm.Pos, "expecting function name")
+	}
+	if p.defined[name.Value] {
+		return errorAt(name.Line, name.Pos, "label %s already defined", name.Value)
+	}
+	fn := &function{name: name.Value}
+	for p.scanRaw() {
+		tok := p.current
+		if !sameLine(tok, itm) {
+			p.backup()
+			break
+		}
+		eq := strings.IndexByte(tok.Value, '=')
+		if tok.Type != ItemIdentifier || eq < 0 {
+			return errorAt(tok.Line, tok.Pos, "expecting args=N or locals=N")
+		}
+		key, value := tok.Value[:eq], tok.Value[eq+1:]
+		if v, ok := p.consts[value]; ok {
+			value = v.Value
+		} else if v, err := parseNumber(value); err == nil {
+			value = v
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > maxLocals {
+			return errorAt(tok.Line, tok.Pos, "invalid %s count %q", key, value)
+		}
+		switch key {
+		case "args":
+			fn.args = n
+		case "locals":
+			fn.locals = n
+		default:
+			return errorAt(tok.Line, tok.Pos, "unknown .func setting %s", key)
+		}
+	}
+	if err := p.lex.Err(); err != nil {
+		return err
+	}
+	if fn.args+fn.locals > maxLocals {
+		return errorAt(itm.Line, itm.Pos, "function %s has more than %d locals", fn.name, maxLocals)
+	}
+	p.defined[fn.name] = true
+	p.fn = fn
+	p.instructions = append(p.instructions,
+		instruction{pseudoInstructionLabel, fn.name, name.Line, name.Pos, p.file},
+		instruction{bytecode.OpEnter, [2]int64{int64(fn.args), int64(fn.locals)}, itm.Line, itm.Pos, p.file})
+	return nil
+}
@@ -3,9 +3,12 @@ package asm
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"unicode"
-	"unicode/utf8"
 )
 
 const (
@@ -15,6 +18,8 @@ const (
 	ItemComma
 	ItemLabel
 	ItemVar
+	ItemDirective
+	ItemFloatLit
 )
 
 type Item struct {
@@ -22,51 +27,103 @@ type Item struct {
 	Value string
 	Line  int
 	Pos   int
+
+	// Items expanded from a macro take the Line and Pos of the invocation,
+	// recording here which expansion they belong to and the line of the
+	// macro body they were read from.
+	expansion, bodyLine int
+}
+
+// sameLine reports whether a and b were read from the same source line,
+// within the same macro expansion if they were expanded from a macro.
+func sameLine(a, b Item) bool {
+	if a.expansion != b.expansion {
+		return false
+	}
+	if a.expansion != 0 {
+		return a.bodyLine == b.bodyLine
+	}
+	return a.Line == b.Line
 }
 
 type Lexer struct {
 	src     *bufio.Reader
 	buf     *bytes.Buffer
+	text    *bytes.Buffer // everything read from src, for Source
 	current Item
 	last    rune
 	line    int
-	pos     int
+	col     int // column of the last rune read
+	lastCol int // col before the last newline, for unread
 	err     error
 }
 
 func NewLexer(r io.Reader) *Lexer {
+	text := &bytes.Buffer{}
 	return &Lexer{
-		src:  bufio.NewReader(r),
+		src:  bufio.NewReader(io.TeeReader(r, text)),
 		buf:  bytes.NewBuffer(make([]byte, 0, 1024)),
+		text: text,
 		line: 1,
 	}
 }
 
+// Source reads the rest of the input and returns all of it. Once called,
+// the lexer has nothing left to scan.
+func (l *Lexer) Source() []byte {
+	io.Copy(ioutil.Discard, l.src)
+	return l.text.Bytes()
+}
+
+// recover clears a syntax error, skipping the rest of the line on which it
+// occurred, and reports whether scanning can continue.
+func (l *Lexer) recover() bool {
+	if _, ok := l.err.(*Diagnostic); !ok {
+		return false
+	}
+	l.err = nil
+	if l.last != '\n' {
+		l.skipComment()
+	}
+	return true
+}
+
 func (l *Lexer) Scanning() bool {
 	l.scan()
 	return l.err == nil
 }
 
+// eof is stored in last when the most recent read failed.
+const eof = -1
+
 func (l *Lexer) read() (rune, error) {
-	ch, size, err := l.src.ReadRune()
+	ch, _, err := l.src.ReadRune()
 	if err != nil {
+		l.last = eof
 		return 0, err
 	}
-	l.pos += size
 	l.last = ch
 	if ch == '\n' {
 		l.line++
+		l.lastCol, l.col = l.col, 0
+	} else {
+		l.col++
 	}
 	return ch, nil
 }
 
 func (l *Lexer) unread() {
+	if l.last == eof {
+		return
+	}
 	l.src.UnreadRune()
 	if l.last == '\n' {
 		l.line--
+		l.col = l.lastCol
+	} else {
+		l.col--
 	}
-	l.pos -= utf8.RuneLen(l.last)
-	l.last = 0 // shouldn't matter, we only ever back up once
+	l.last = eof // we only ever back up once
 }
 
 func (l *Lexer) peek() (rune, error) {
@@ -77,27 +134,43 @@ func (l *Lexer) peek() (rune, error) {
 
 func (l *Lexer) skipSpace() {
 	for {
-		ch, _ := l.read()
+		ch, err := l.read()
+		if err != nil {
+			return
+		}
 		if !unicode.IsSpace(ch) {
 			l.unread()
-			break
+			return
 		}
 	}
 }
 
+func (l *Lexer) skipComment() {
+	for {
+		ch, err := l.read()
+		if err != nil || ch == '\n' {
+			return
+		}
+	}
+}
+
+func isComment(ch rune) bool { return ch == ';' || ch == '#' }
+
+// isDelimiter reports whether ch ends an identifier or literal.
+func isDelimiter(ch rune) bool { return unicode.IsSpace(ch) || isComment(ch) || ch == ',' }
+
 func (l *Lexer) scanIdent() (Item, error) {
 	defer l.buf.Reset()
-	line, pos := l.line, l.pos+1
+	line, pos := l.line, l.col+1
 	for {
 		ch, err := l.read()
 		if err != nil {
 			if l.buf.Len() == 0 {
 				return Item{}, err
 			}
-			l.unread()
 			break
 		}
-		if unicode.IsSpace(ch) {
+		if isDelimiter(ch) {
 			l.unread()
 			break
 		}
@@ -106,30 +179,216 @@ func (l *Lexer) scanIdent() (Item, error) {
 	return Item{Type: ItemIdentifier, Value: l.buf.String(), Line: line, Pos: pos}, nil
 }
 
+// scanNumber scans a number literal. An integer literal is an optional minus
+// sign followed by decimal digits, or by 0x, 0b or 0o and hexadecimal, binary
+// or octal digits, with single underscores allowed between digits, and the
+// item's value is the number in decimal. Literals with a fractional part or
+// exponent are floats; see parseFloat.
 func (l *Lexer) scanNumber() (Item, error) {
 	defer l.buf.Reset()
-	line, pos := l.line, l.pos+1
+	line, pos := l.line, l.col+1
 	for {
 		ch, err := l.read()
 		if err != nil {
-			if l.buf.Len() == 0 {
-				return Item{}, err
-			}
-			l.unread()
 			break
 		}
-		if !unicode.IsDigit(ch) && ch != '-' {
+		if isDelimiter(ch) {
 			l.unread()
 			break
 		}
 		l.buf.WriteRune(ch)
 	}
-	return Item{Type: ItemNumLit, Value: l.buf.String(), Line: line, Pos: pos}, nil
+	text := l.buf.String()
+	typ, parse := ItemNumLit, parseNumber
+	if isFloat(text) {
+		typ, parse = ItemFloatLit, parseFloat
+	}
+	value, err := parse(text)
+	if err != nil {
+		return Item{}, errorAt(line, pos, "%v %q", err, text)
+	}
+	return Item{Type: typ, Value: value, Line: line, Pos: pos}, nil
+}
+
+// isFloat reports whether text is written as a float: a decimal number with
+// a fractional part or exponent.
+func isFloat(text string) bool {
+	digits := strings.TrimPrefix(text, "-")
+	if len(digits) > 1 && digits[0] == '0' && strings.ContainsRune("xXbBoO", rune(digits[1])) {
+		return false
+	}
+	return strings.ContainsAny(digits, ".eE")
+}
+
+// parseFloat parses a float literal: decimal digits with an optional
+// fractional part and exponent, such as 1.5, -0.25, 6.02e23 or 1e-9, with
+// single underscores allowed between digits. It returns the number in the
+// shortest form that parses back to the same float64.
+func parseFloat(text string) (string, error) {
+	digits := strings.TrimPrefix(text, "-")
+	for i, ch := range digits {
+		isDigit := ch >= '0' && ch <= '9'
+		if ch == '_' && (i == 0 || i == len(digits)-1 || !isDecimal(digits[i-1]) || !isDecimal(digits[i+1])) {
+			return "", errors.New("malformed number")
+		}
+		if !isDigit && !strings.ContainsRune("_.eE+-", ch) {
+			return "", errors.New("malformed number")
+		}
+	}
+	if !isDecimal(digits[0]) {
+		return "", errors.New("malformed number")
+	}
+	f, err := strconv.ParseFloat(strings.Replace(text, "_", "", -1), 64)
+	if err != nil {
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return "", errors.New("number out of range")
+		}
+		return "", errors.New("malformed number")
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
+
+func isDecimal(b byte) bool { return b >= '0' && b <= '9' }
+
+func parseNumber(text string) (string, error) {
+	neg := strings.HasPrefix(text, "-")
+	digits := strings.TrimPrefix(text, "-")
+	base := 10
+	if len(digits) > 1 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+		if base != 10 {
+			digits = digits[2:]
+		}
+	}
+	if digits == "" || digits[0] == '_' || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+		return "", errors.New("malformed number")
+	}
+	n, err := strconv.ParseUint(strings.Replace(digits, "_", "", -1), base, 64)
+	if err != nil {
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return "", errors.New("number out of range")
+		}
+		return "", errors.New("malformed number")
+	}
+	value := strconv.FormatUint(n, 10)
+	if neg {
+		value = "-" + value
+	}
+	return value, nil
+}
+
+// scanChar scans a single quoted character literal, returning a number item
+// whose value is the character's code in decimal.
+func (l *Lexer) scanChar() (Item, error) {
+	line, pos := l.line, l.col+1
+	l.read() // opening quote
+	ch, err := l.read()
+	if err != nil || ch == '\n' {
+		return Item{}, errorAt(line, pos, "unterminated character literal")
+	}
+	if ch == '\'' {
+		return Item{}, errorAt(line, pos, "empty character literal")
+	}
+	code := int(ch)
+	if ch == '\\' {
+		b, err := l.scanEscape()
+		if err != nil {
+			return Item{}, err
+		}
+		code = int(b)
+	}
+	if ch, err := l.read(); err != nil || ch != '\'' {
+		if err == nil && !isDelimiter(ch) {
+			return Item{}, errorAt(line, pos, "character literal has more than one character")
+		}
+		return Item{}, errorAt(line, pos, "unterminated character literal")
+	}
+	return Item{Type: ItemNumLit, Value: strconv.Itoa(code), Line: line, Pos: pos}, nil
+}
+
+var escapes = map[rune]byte{'n': '\n', 't': '\t', 'r': '\r', '0': 0, '\\': '\\', '"': '"', '\'': '\''}
+
+// scanString scans a double quoted string literal, returning an item whose
+// value is the string with its escape sequences decoded.
+func (l *Lexer) scanString() (Item, error) {
+	defer l.buf.Reset()
+	line, pos := l.line, l.col+1
+	l.read() // opening quote
+	for {
+		ch, err := l.read()
+		if err == io.EOF || ch == '\n' {
+			return Item{}, errorAt(line, pos, "unterminated string literal")
+		}
+		if err != nil {
+			return Item{}, err
+		}
+		switch ch {
+		case '"':
+			return Item{Type: ItemStringLit, Value: l.buf.String(), Line: line, Pos: pos}, nil
+		case '\\':
+			b, err := l.scanEscape()
+			if err != nil {
+				return Item{}, err
+			}
+			l.buf.WriteByte(b)
+		default:
+			l.buf.WriteRune(ch)
+		}
+	}
+}
+
+// scanEscape scans the remainder of an escape sequence following a backslash.
+func (l *Lexer) scanEscape() (byte, error) {
+	line, pos := l.line, l.col
+	ch, err := l.read()
+	if err != nil || ch == '\n' {
+		return 0, errorAt(line, pos, "unterminated escape sequence")
+	}
+	if b, ok := escapes[ch]; ok {
+		return b, nil
+	}
+	if ch != 'x' {
+		return 0, errorAt(line, pos, "unknown escape sequence \\%c", ch)
+	}
+	var b byte
+	for i := 0; i < 2; i++ {
+		ch, err := l.read()
+		d, ok := hexDigit(ch)
+		if err != nil || !ok {
+			return 0, errorAt(line, pos, "invalid \\x escape sequence")
+		}
+		b = b<<4 | d
+	}
+	return b, nil
+}
+
+func hexDigit(ch rune) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return byte(ch - '0'), true
+	case ch >= 'a' && ch <= 'f':
+		return byte(ch-'a') + 10, true
+	case ch >= 'A' && ch <= 'F':
+		return byte(ch-'A') + 10, true
+	}
+	return 0, false
 }
 
 func (l *Lexer) scan() {
 	l.skipSpace()
 	ch, err := l.peek()
+	for err == nil && isComment(ch) {
+		l.skipComment()
+		l.skipSpace()
+		ch, err = l.peek()
+	}
 	if err != nil {
 		l.err = err
 		return
@@ -143,12 +402,32 @@ func (l *Lexer) scan() {
 		l.current, l.err = l.scanNumber()
 		return
 	}
+	if ch == '"' {
+		l.current, l.err = l.scanString()
+		return
+	}
+	if ch == '\'' {
+		l.current, l.err = l.scanChar()
+		return
+	}
+	if ch == ',' {
+		l.read()
+		l.current = Item{Type: ItemComma, Value: ",", Line: l.line, Pos: l.col}
+		return
+	}
+	if ch == '.' {
+		l.current, l.err = l.scanIdent()
+		l.current.Type = ItemDirective
+		return
+	}
 	if unicode.IsLetter(ch) {
 		l.current, l.err = l.scanIdent()
 		if l.current.Value == "var" {
 			l.current.Type = ItemVar
 		}
+		return
 	}
+	l.err = errorAt(l.line, l.col+1, "unexpected character %q", ch)
 }
 
 func (l *Lexer) Item() Item { return l.current }
@@ -21,6 +21,50 @@ func TestLexer(t *testing.T) {
 				{Type: ItemIdentifier, Value: "halt", Line: 1, Pos: 32},
 			},
 		},
+		{
+			"; header\ndup; trailing\n  ;\nhalt ; done",
+			[]Item{
+				{Type: ItemIdentifier, Value: "dup", Line: 2, Pos: 1},
+				{Type: ItemIdentifier, Value: "halt", Line: 4, Pos: 1},
+			},
+		},
+		{
+			`var t 1, 2 "a\"b\x41\n"`,
+			[]Item{
+				{Type: ItemVar, Value: "var", Line: 1, Pos: 1},
+				{Type: ItemIdentifier, Value: "t", Line: 1, Pos: 5},
+				{Type: ItemNumLit, Value: "1", Line: 1, Pos: 7},
+				{Type: ItemComma, Value: ",", Line: 1, Pos: 8},
+				{Type: ItemNumLit, Value: "2", Line: 1, Pos: 10},
+				{Type: ItemStringLit, Value: "a\"bA\n", Line: 1, Pos: 12},
+			},
+		},
+		{
+			"# header\n  push_int64 0x7f_ff # hex\n0b1010,0o17 -1_000 'a' '\\n' '\\x41' ';'",
+			[]Item{
+				{Type: ItemIdentifier, Value: "push_int64", Line: 2, Pos: 3},
+				{Type: ItemNumLit, Value: "32767", Line: 2, Pos: 14},
+				{Type: ItemNumLit, Value: "10", Line: 3, Pos: 1},
+				{Type: ItemComma, Value: ",", Line: 3, Pos: 7},
+				{Type: ItemNumLit, Value: "15", Line: 3, Pos: 8},
+				{Type: ItemNumLit, Value: "-1000", Line: 3, Pos: 13},
+				{Type: ItemNumLit, Value: "97", Line: 3, Pos: 20},
+				{Type: ItemNumLit, Value: "10", Line: 3, Pos: 24},
+				{Type: ItemNumLit, Value: "65", Line: 3, Pos: 29},
+				{Type: ItemNumLit, Value: "59", Line: 3, Pos: 36},
+			},
+		},
+		{
+			"push_float64 1.5 -0.25 6.02e23 1e-9 1_000.5",
+			[]Item{
+				{Type: ItemIdentifier, Value: "push_float64", Line: 1, Pos: 1},
+				{Type: ItemFloatLit, Value: "1.5", Line: 1, Pos: 14},
+				{Type: ItemFloatLit, Value: "-0.25", Line: 1, Pos: 18},
+				{Type: ItemFloatLit, Value: "6.02e+23", Line: 1, Pos: 24},
+				{Type: ItemFloatLit, Value: "1e-09", Line: 1, Pos: 32},
+				{Type: ItemFloatLit, Value: "1000.5", Line: 1, Pos: 37},
+			},
+		},
 	} {
 		lex := NewLexer(strings.NewReader(tt.input))
 		var items []Item
@@ -32,3 +76,38 @@ func TestLexer(t *testing.T) {
 		}
 	}
 }
+
+func TestLexerErrors(t *testing.T) {
+	for i, tt := range []struct {
+		input, expected string
+	}{
+		{`"abc`, "unterminated string literal at line 1 pos 1"},
+		{"dup \"ab\ncd\"", "unterminated string literal at line 1 pos 5"},
+		{`"\q"`, `unknown escape sequence \q at line 1 pos 2`},
+		{`"\x4g"`, `invalid \x escape sequence at line 1 pos 2`},
+		{"dup @", `unexpected character '@' at line 1 pos 5`},
+		{"halt\n  push_int64 1-2", `malformed number "1-2" at line 2 pos 14`},
+		{"push_int64 0x", `malformed number "0x" at line 1 pos 12`},
+		{"push_int64 0b102", `malformed number "0b102" at line 1 pos 12`},
+		{"push_int64 1__0", `malformed number "1__0" at line 1 pos 12`},
+		{"push_int64 _1", `unexpected character '_' at line 1 pos 12`},
+		{"push_int64 1_", `malformed number "1_" at line 1 pos 12`},
+		{"push_int64 0x1_0000_0000_0000_0000", `number out of range "0x1_0000_0000_0000_0000" at line 1 pos 12`},
+		{"push_float64 1.5.2", `malformed number "1.5.2" at line 1 pos 14`},
+		{"push_float64 1e", `malformed number "1e" at line 1 pos 14`},
+		{"push_float64 1._5", `malformed number "1._5" at line 1 pos 14`},
+		{"push_float64 0x1.5", `malformed number "0x1.5" at line 1 pos 14`},
+		{"push_float64 1e400", `number out of range "1e400" at line 1 pos 14`},
+		{"push_uint8 ''", "empty character literal at line 1 pos 12"},
+		{"push_uint8 'ab'", "character literal has more than one character at line 1 pos 12"},
+		{"push_uint8 'a", "unterminated character literal at line 1 pos 12"},
+		{`push_uint8 '\z'`, `unknown escape sequence \z at line 1 pos 13`},
+	} {
+		lex := NewLexer(strings.NewReader(tt.input))
+		for lex.Scanning() {
+		}
+		if err := lex.Err(); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package asm
+
+import "fmt"
+
+// maxExpansions bounds the number of macros expanded in one source, so that
+// a macro which invokes itself fails rather than expanding forever.
+const maxExpansions = 10000
+
+type macro struct {
+	name   string
+	params []string
+	body   []Item
+	locals map[string]bool // labels defined in the body
+}
+
+// checkName reports an error if name cannot be given to a new constant or macro.
+func (p *Parser) checkName(name Item) error {
+	if name.Type != ItemIdentifier {
+		return errorAt(name.Line, name.Pos, "expecting name")
+	}
+	if _, ok := imap[name.Value]; ok {
+		return errorAt(name.Line, name.Pos, "%s is an instruction", name.Value)
+	}
+	if _, ok := p.macros[name.Value]; ok {
+		return errorAt(name.Line, name.Pos, "macro %s already defined", name.Value)
+	}
+	return nil
+}
+
+// parseConst parses `.const NAME value`, where value is an integer or float
+// or a previously defined constant.
+func (p *Parser) parseConst(itm Item) error {
+	if !p.scanRaw() {
+		return p.unexpectedEnd(itm)
+	}
+	name := p.current
+	if err := p.checkName(name); err != nil {
+		return err
+	}
+	if _, ok := p.consts[name.Value]; ok {
+		return errorAt(name.Line, name.Pos, "constant %s already defined", name.Value)
+	}
+	value, err := p.next(name)
+	if err != nil {
+		return err
+	}
+	if value.Type != ItemNumLit && value.Type != ItemFloatLit {
+		return errorAt(value.Line, value.Pos, "expecting numeric value for constant %s", name.Value)
+	}
+	p.consts[name.Value] = value
+	return nil
+}
+
+// parseMacro parses a macro definition: `.macro name` followed by parameter
+// names on the same line, the body, and `.endm`. The body is read directly
+// from the lexer, so that constants are substituted when it is expanded
+// rather than when it is defined.
+func (p *Parser) parseMacro(itm Item) error {
+	if len(p.pending) > 0 {
+		return errorAt(itm.Line, itm.Pos, "macro defined inside a macro expansion")
+	}
+	if !p.scanRaw() {
+		return p.unexpectedEnd(itm)
+	}
+	name := p.current
+	if !sameLine(name, itm) {
+		return errorAt(itm.Line, itm.Pos, "expecting macro name")
+	}
+	if err := p.checkName(name); err != nil {
+		return err
+	}
+	if _, ok := p.consts[name.Value]; ok {
+		return errorAt(name.Line, name.Pos, "%s is a constant", name.Value)
+	}
+	m := &macro{name: name.Value, locals: make(map[string]bool)}
+	for {
+		if !p.scanRaw() {
+			return p.unterminated(itm)
+		}
+		tok := p.current
+		if !sameLine(tok, itm) {
+			p.backup()
+			break
+		}
+		if tok.Type == ItemComma {
+			continue
+		}
+		if tok.Type != ItemIdentifier {
+			return errorAt(tok.Line, tok.Pos, "expecting parameter name")
+		}
+		m.params = append(m.params, tok.Value)
+	}
+	for {
+		if !p.scanRaw() {
+			return p.unterminated(itm)
+		}
+		tok := p.current
+		if tok.Type == ItemDirective {
+			if tok.Value == ".endm" {
+				break
+			}
+			if tok.Value == ".macro" {
+				return errorAt(tok.Line, tok.Pos, "nested macro definition")
+			}
+		}
+		if tok.Type == ItemLabel && len(tok.Value) > 1 {
+			m.locals[tok.Value[1:]] = true
+		}
+		m.body = append(m.body, tok)
+	}
+	p.macros[m.name] = m
+	return nil
+}
+
+func (p *Parser) unexpectedEnd(itm Item) error {
+	if err := p.lex.Err(); err != nil {
+		return err
+	}
+	return errorAt(itm.Line, itm.Pos, "unexpected end of input after %s", itm.Value)
+}
+
+func (p *Parser) unterminated(itm Item) error {
+	if err := p.lex.Err(); err != nil {
+		return err
+	}
+	return errorAt(itm.Line, itm.Pos, "macro without .endm")
+}
+
+// expand reads the arguments of the invocation of m at itm, which must be on
+// the same line, and queues its body for parsing. Parameters in the body are
+// replaced by the arguments, and labels defined in the body are renamed so
+// that each expansion has its own. The expanded items take the position of
+// the invocation, but keep the lines of the body for same-line checks.
+func (p *Parser) expand(m *macro, itm Item) error {
+	if p.expansions++; p.expansions > maxExpansions {
+		return errorAt(itm.Line, itm.Pos, "too many expansions of macro %s, is it recursive?", m.name)
+	}
+	args := make(map[string]Item)
+	prev := itm
+	for _, param := range m.params {
+		arg, err := p.next(prev)
+		if err != nil {
+			return err
+		}
+		if arg.Type == ItemComma && sameLine(arg, itm) {
+			if arg, err = p.next(arg); err != nil {
+				return err
+			}
+		}
+		if !sameLine(arg, itm) {
+			return errorAt(itm.Line, itm.Pos, "expecting argument %s to macro %s", param, m.name)
+		}
+		if arg.Type != ItemIdentifier && arg.Type != ItemNumLit && arg.Type != ItemFloatLit && arg.Type != ItemStringLit {
+			return errorAt(arg.Line, arg.Pos, "expecting argument %s to macro %s", param, m.name)
+		}
+		args[param] = arg
+		prev = arg
+	}
+	prefix := fmt.Sprintf("%s.%d.", m.name, p.expansions)
+	body := make([]Item, 0, len(m.body)+len(p.pending))
+	for _, tok := range m.body {
+		line := tok.Line
+		switch {
+		case tok.Type == ItemLabel && m.locals[tok.Value[1:]]:
+			tok.Value = ":" + prefix + tok.Value[1:]
+		case tok.Type == ItemIdentifier && m.locals[tok.Value]:
+			tok.Value = prefix + tok.Value
+		case tok.Type == ItemIdentifier:
+			if arg, ok := args[tok.Value]; ok {
+				tok = arg
+			}
+		}
+		tok.expansion, tok.bodyLine = p.expansions, line
+		tok.Line, tok.Pos = itm.Line, itm.Pos
+		body = append(body, tok)
+	}
+	p.pending = append(body, p.pending...)
+	return nil
+}
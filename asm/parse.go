@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 
 	"github.com/bruston/lil/bytecode"
@@ -16,6 +17,35 @@ type Parser struct {
 	out          *bytes.Buffer
 	labels       map[string]int
 	vars         map[string]int
+	data         []bytecode.DataInit
+	lines        []bytecode.LineInfo
+	consts       map[string]Item // number items by name
+	macros       map[string]*macro
+	expansions   int    // macros expanded so far
+	pending      []Item // remainder of the current macro expansion
+	current      Item
+	backed       bool     // the next scan returns current again
+	files        []string // source files, files[0] being the one assembled
+	file         int      // index into files of the file being lexed
+	includes     []include
+	exports      []symbol
+	decls        []symbol        // var declarations
+	defined      map[string]bool // labels defined so far
+	lexers       []*Lexer        // the lexer of each file
+	fn           *function       // the last .func, if any
+	diags        Diagnostics
+}
+
+// symbol is a name appearing in the source, and the file it appeared in.
+type symbol struct {
+	name Item
+	file int
+}
+
+// include is a file whose lexing is suspended while it includes another.
+type include struct {
+	lex  *Lexer
+	file int
 }
 
 const (
@@ -28,133 +58,472 @@ type instruction struct {
 	arg  interface{}
 	line int
 	pos  int
+	file int
 }
 
+// Parse parses the source, and any files it includes, into instructions.
+// Parsing continues after an error, resuming on the next line, so that every
+// error in the source is found; they are returned as Diagnostics. Each names
+// the file in which it occurred, if known. Warnings are recorded but do not
+// cause Parse to fail; Diagnostics returns them.
 func (p *Parser) Parse() error {
-	for p.lex.Scanning() {
-		itm := p.lex.Item()
-		ins := instruction{}
-		switch itm.Type {
-		case ItemLabel:
-			if len(itm.Value) < 2 {
-				return fmt.Errorf("label cannot be empty at line %d pos %d", itm.Line, itm.Pos)
-			}
-			itm.Value = itm.Value[1:]
-			p.instructions = append(p.instructions, instruction{pseudoInstructionLabel, itm.Value, itm.Line, itm.Pos})
-			continue
-		case ItemVar:
-			p.lex.scan()
-			itm := p.lex.Item()
-			if itm.Type != ItemIdentifier {
-				return fmt.Errorf("expecting identifier at line %d pos %d", itm.Line, itm.Pos)
+	p.parse()
+	p.checkExports()
+	p.lint()
+	p.annotate()
+	return p.diags.Err()
+}
+
+func (p *Parser) parse() {
+	for {
+		if !p.scan() {
+			err := p.lex.Err()
+			if err == nil {
+				return
 			}
-			if _, ok := p.vars[itm.Value]; ok {
-				return fmt.Errorf("variable %d already declared at line %d pos %d", itm.Line, itm.Pos)
+			p.report(err)
+			if !p.lex.recover() {
+				return
 			}
-			p.vars[itm.Value] = len(p.vars)
 			continue
 		}
-		op, ok := imap[itm.Value]
-		if itm.Type != ItemIdentifier || !ok {
-			return fmt.Errorf("invalid instruction at line %d pos %d", itm.Line, itm.Pos)
-		}
-		ins.op = op
-		ins.line, ins.pos = itm.Line, itm.Pos
-		switch ins.op {
-		case bytecode.OpCall, bytecode.OpJump, bytecode.OpJumpEq, bytecode.OpJumpGT, bytecode.OpJumpLT,
-			bytecode.OpJumpTrue, bytecode.OpJumpFalse, bytecode.OpJumpNotEq:
-			p.lex.scan()
-			arg := p.lex.Item()
-			if arg.Type != ItemIdentifier {
-				return fmt.Errorf("expecting label identifer at line %d pos %d", itm.Line, itm.Pos)
-			}
-			ins.arg = arg.Value
-			p.instructions = append(p.instructions, ins)
-			continue
-		case bytecode.OpLoad, bytecode.OpStore:
-			p.lex.scan()
-			arg := p.lex.Item()
-			if arg.Type != ItemIdentifier {
-				return fmt.Errorf("expecting label identifer at line %d pos %d", itm.Line, itm.Pos)
-			}
-			ins.arg = arg.Value
-			p.instructions = append(p.instructions, ins)
-			continue
-		case bytecode.OpPushUint8:
-			p.lex.scan()
-			arg := p.lex.Item()
-			if arg.Type != ItemNumLit {
-				fmt.Errorf("expecting numeric argument, got type: %d at line %d pos %d", arg.Type, itm.Line, itm.Pos)
+		if err := p.parseItem(p.current); err != nil {
+			p.report(err)
+			if !p.sync(err) {
+				return
 			}
-			n, err := strconv.ParseUint(arg.Value, 10, 64)
-			if err != nil || n > 255 {
-				return fmt.Errorf("invalid uint8 at line %d pos %d", itm.Line, itm.Pos)
+		}
+	}
+}
+
+// sync skips the rest of the line on which err occurred, reporting whether
+// parsing can continue.
+func (p *Parser) sync(err error) bool {
+	if p.lex.Err() != nil {
+		return p.lex.recover()
+	}
+	line, file := p.current.Line, p.file
+	if d, ok := err.(*Diagnostic); ok && d.Line > 0 && d.Line < line {
+		// The error was found after reading on to the next line, which
+		// may be fine.
+		p.backup()
+		return true
+	}
+	for p.scanRaw() {
+		if p.current.Line != line || p.file != file {
+			p.backup()
+			return true
+		}
+	}
+	if err := p.lex.Err(); err != nil {
+		p.report(err)
+		return p.lex.recover()
+	}
+	return false
+}
+
+func (p *Parser) parseItem(itm Item) error {
+	ins := instruction{}
+	switch itm.Type {
+	case ItemDirective:
+		return p.parseDirective(itm)
+	case ItemLabel:
+		if len(itm.Value) < 2 {
+			return errorAt(itm.Line, itm.Pos, "label cannot be empty")
+		}
+		itm.Value = itm.Value[1:]
+		if p.defined[itm.Value] {
+			return errorAt(itm.Line, itm.Pos, "label %s already defined", itm.Value)
+		}
+		p.defined[itm.Value] = true
+		p.instructions = append(p.instructions, instruction{pseudoInstructionLabel, itm.Value, itm.Line, itm.Pos, p.file})
+		return nil
+	case ItemVar:
+		itm, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		if itm.Type != ItemIdentifier {
+			return errorAt(itm.Line, itm.Pos, "expecting identifier")
+		}
+		if _, ok := p.vars[itm.Value]; ok {
+			return errorAt(itm.Line, itm.Pos, "variable %s already declared", itm.Value)
+		}
+		p.vars[itm.Value] = len(p.vars)
+		p.decls = append(p.decls, symbol{itm, p.file})
+		init, ok, err := p.parseInitialiser()
+		if err != nil {
+			return err
+		}
+		if ok {
+			p.data = append(p.data, bytecode.DataInit{Slot: p.vars[itm.Value], Value: init})
+		}
+		return nil
+	}
+	if m, ok := p.macros[itm.Value]; ok && itm.Type == ItemIdentifier {
+		return p.expand(m, itm)
+	}
+	op, ok := imap[itm.Value]
+	if itm.Type != ItemIdentifier || !ok {
+		return errorAt(itm.Line, itm.Pos, "invalid instruction")
+	}
+	ins.op = op
+	ins.line, ins.pos, ins.file = itm.Line, itm.Pos, p.file
+	switch ins.op {
+	case bytecode.OpCall, bytecode.OpJump, bytecode.OpJumpEq, bytecode.OpJumpGT, bytecode.OpJumpLT,
+		bytecode.OpJumpTrue, bytecode.OpJumpFalse, bytecode.OpJumpNotEq:
+		arg, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		if arg.Type != ItemIdentifier {
+			return errorAt(itm.Line, itm.Pos, "expecting label identifier")
+		}
+		ins.arg = arg.Value
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpLoad, bytecode.OpStore:
+		arg, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		if arg.Type != ItemIdentifier {
+			return errorAt(itm.Line, itm.Pos, "expecting variable identifier")
+		}
+		ins.arg = arg.Value
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpMov:
+		var names [2]string
+		for i := range names {
+			arg, err := p.next(itm)
+			if err != nil {
+				return err
 			}
-			ins.arg = uint8(n)
-			p.instructions = append(p.instructions, ins)
-		case bytecode.OpPushInt64:
-			p.lex.scan()
-			arg := p.lex.Item()
-			if arg.Type != ItemNumLit {
-				return fmt.Errorf("invalid int64 at line %d pos %d", itm.Line, itm.Pos)
+			if arg.Type != ItemIdentifier {
+				return errorAt(itm.Line, itm.Pos, "expecting variable identifier")
 			}
-			n, err := strconv.ParseInt(arg.Value, 10, 64)
+			names[i] = arg.Value
+		}
+		ins.arg = names
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpPushUint8:
+		arg, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		if arg.Type != ItemNumLit {
+			return errorAt(itm.Line, itm.Pos, "expecting numeric argument, got type: %d", arg.Type)
+		}
+		n, err := strconv.ParseUint(arg.Value, 10, 64)
+		if err != nil || n > 255 {
+			return errorAt(itm.Line, itm.Pos, "invalid uint8")
+		}
+		ins.arg = uint8(n)
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpPushInt64:
+		arg, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		if arg.Type != ItemNumLit {
+			return errorAt(itm.Line, itm.Pos, "invalid int64")
+		}
+		n, err := strconv.ParseInt(arg.Value, 10, 64)
+		if err != nil {
+			return errorAt(itm.Line, itm.Pos, "invalid int64")
+		}
+		ins.arg = n
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpPushUint64:
+		arg, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseUint(arg.Value, 10, 64)
+		if arg.Type != ItemNumLit || err != nil {
+			return errorAt(itm.Line, itm.Pos, "invalid uint64")
+		}
+		ins.arg = n
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpPushFloat64:
+		arg, err := p.next(itm)
+		if err != nil {
+			return err
+		}
+		if arg.Type != ItemFloatLit && arg.Type != ItemNumLit {
+			return errorAt(itm.Line, itm.Pos, "invalid float64")
+		}
+		f, err := strconv.ParseFloat(arg.Value, 64)
+		if err != nil {
+			return errorAt(itm.Line, itm.Pos, "invalid float64")
+		}
+		ins.arg = f
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpLoadLocal, bytecode.OpStoreLocal:
+		n, err := p.count(itm)
+		if err != nil {
+			return err
+		}
+		if p.fn == nil {
+			return errorAt(itm.Line, itm.Pos, "%s outside of a .func", itm.Value)
+		}
+		if n >= int64(p.fn.args+p.fn.locals) {
+			return errorAt(itm.Line, itm.Pos, "local %d out of range, function %s has %d", n, p.fn.name, p.fn.args+p.fn.locals)
+		}
+		ins.arg = n
+		p.instructions = append(p.instructions, ins)
+	case bytecode.OpEnter:
+		var counts [2]int64
+		for i := range counts {
+			n, err := p.count(itm)
 			if err != nil {
-				return fmt.Errorf("invalid int64 at line %d pos %d", itm.Line, itm.Pos)
+				return err
 			}
-			ins.arg = n
-			p.instructions = append(p.instructions, ins)
-		default:
-			p.instructions = append(p.instructions, ins)
+			counts[i] = n
 		}
+		// Check later locals against this frame, as if it were declared by .func.
+		p.fn = &function{name: p.lastLabel(), args: int(counts[0]), locals: int(counts[1])}
+		ins.arg = counts
+		p.instructions = append(p.instructions, ins)
+	default:
+		p.instructions = append(p.instructions, ins)
 	}
 	return nil
 }
 
+// lastLabel returns the name of the last label defined.
+func (p *Parser) lastLabel() string {
+	for i := len(p.instructions) - 1; i >= 0; i-- {
+		if p.instructions[i].op == pseudoInstructionLabel {
+			return p.instructions[i].arg.(string)
+		}
+	}
+	return "main"
+}
+
+// count parses the non-negative number following itm.
+func (p *Parser) count(itm Item) (int64, error) {
+	arg, err := p.next(itm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(arg.Value, 10, 64)
+	if arg.Type != ItemNumLit || err != nil || n < 0 || n > maxLocals {
+		return 0, errorAt(itm.Line, itm.Pos, "expecting count after %s", itm.Value)
+	}
+	return n, nil
+}
+
+// scan advances to the next item, taking it from the current macro
+// expansion before the lexer. Identifiers naming constants are replaced by
+// their values.
+func (p *Parser) scan() bool {
+	if !p.scanRaw() {
+		return false
+	}
+	if v, ok := p.consts[p.current.Value]; ok && p.current.Type == ItemIdentifier {
+		p.current.Type, p.current.Value = v.Type, v.Value
+	}
+	return true
+}
+
+// scanRaw is like scan but leaves constants unsubstituted.
+func (p *Parser) scanRaw() bool {
+	if p.backed {
+		p.backed = false
+		return true
+	}
+	if len(p.pending) > 0 {
+		p.current, p.pending = p.pending[0], p.pending[1:]
+		return true
+	}
+	for !p.lex.Scanning() {
+		if p.lex.Err() != nil || len(p.includes) == 0 {
+			return false
+		}
+		inc := p.includes[len(p.includes)-1]
+		p.includes = p.includes[:len(p.includes)-1]
+		p.lex, p.file = inc.lex, inc.file
+	}
+	p.current = p.lex.Item()
+	return true
+}
+
+// backup causes the next scan to return the current item again.
+func (p *Parser) backup() { p.backed = true }
+
+// next scans the item following prev, reporting lexer errors and the end of
+// the input as errors.
+func (p *Parser) next(prev Item) (Item, error) {
+	if !p.scan() {
+		return Item{}, p.unexpectedEnd(prev)
+	}
+	return p.current, nil
+}
+
+// parseInitialiser parses the optional initial value following a var
+// declaration: a string literal, which becomes an array of uint8, a single
+// number, or a comma separated list of numbers, which becomes an array of
+// int64 and float64 elements.
+func (p *Parser) parseInitialiser() (bytecode.Constant, bool, error) {
+	if !p.scan() {
+		return bytecode.Constant{}, false, p.lex.Err()
+	}
+	itm := p.current
+	switch itm.Type {
+	case ItemStringLit:
+		c := bytecode.Constant{Kind: bytecode.ConstArray, Elems: []bytecode.Constant{}}
+		for i := 0; i < len(itm.Value); i++ {
+			c.Elems = append(c.Elems, bytecode.Constant{Kind: bytecode.ConstUint8, Int: int64(itm.Value[i])})
+		}
+		return c, true, nil
+	case ItemNumLit, ItemFloatLit:
+	default:
+		p.backup()
+		return bytecode.Constant{}, false, nil
+	}
+	var elems []bytecode.Constant
+	for {
+		c, err := numberConstant(itm)
+		if err != nil {
+			return bytecode.Constant{}, false, err
+		}
+		elems = append(elems, c)
+		if !p.scan() {
+			break
+		}
+		if p.current.Type != ItemComma {
+			p.backup()
+			break
+		}
+		if !p.scan() {
+			return bytecode.Constant{}, false, errorAt(itm.Line, itm.Pos, "expecting number after comma")
+		}
+		if itm = p.current; itm.Type != ItemNumLit && itm.Type != ItemFloatLit {
+			return bytecode.Constant{}, false, errorAt(itm.Line, itm.Pos, "expecting number after comma")
+		}
+	}
+	if err := p.lex.Err(); err != nil {
+		return bytecode.Constant{}, false, err
+	}
+	if len(elems) == 1 {
+		return elems[0], true, nil
+	}
+	return bytecode.Constant{Kind: bytecode.ConstArray, Elems: elems}, true, nil
+}
+
+// numberConstant converts an integer or float literal to a constant.
+func numberConstant(itm Item) (bytecode.Constant, error) {
+	if itm.Type == ItemFloatLit {
+		f, err := strconv.ParseFloat(itm.Value, 64)
+		if err != nil {
+			return bytecode.Constant{}, errorAt(itm.Line, itm.Pos, "invalid float64")
+		}
+		return bytecode.Constant{Kind: bytecode.ConstFloat64, Float: f}, nil
+	}
+	n, err := strconv.ParseInt(itm.Value, 10, 64)
+	if err != nil {
+		return bytecode.Constant{}, errorAt(itm.Line, itm.Pos, "invalid int64")
+	}
+	return bytecode.Constant{Kind: bytecode.ConstInt64, Int: n}, nil
+}
+
 func NewParser(l *Lexer) *Parser {
 	return &Parser{
-		lex:    l,
-		out:    &bytes.Buffer{},
-		labels: make(map[string]int),
-		vars:   make(map[string]int),
+		lex:     l,
+		out:     &bytes.Buffer{},
+		labels:  make(map[string]int),
+		vars:    make(map[string]int),
+		consts:  make(map[string]Item),
+		macros:  make(map[string]*macro),
+		defined: make(map[string]bool),
+		files:   []string{""},
+		lexers:  []*Lexer{l},
 	}
 }
 
+// maxLayoutPasses bounds the number of times Compile lays out the code while
+// waiting for label offsets to settle.
+const maxLayoutPasses = 16
+
+// Compile lays out the parsed instructions as code, returning the code, the
+// offset of main and the number of data slots. It fails if parsing did, or if
+// the source refers to undefined labels or vars.
 func (p *Parser) Compile() ([]byte, int, int, error) {
+	p.checkRefs()
+	p.annotate()
+	if err := p.diags.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+	for _, v := range p.instructions {
+		if v.op == pseudoInstructionLabel {
+			p.labels[v.arg.(string)] = 0
+		}
+	}
+	// Branch arguments are varints, so the size of the code depends on the
+	// label offsets and vice versa. Forward references start out at zero and
+	// the code is laid out again until no label moves.
+	for i := 0; i < maxLayoutPasses; i++ {
+		moved, err := p.layout()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if !moved {
+			return p.out.Bytes(), p.labels["main"], len(p.vars), nil
+		}
+	}
+	return nil, 0, 0, errors.New("label offsets did not settle")
+}
+
+func (p *Parser) layout() (bool, error) {
+	p.out.Reset()
+	p.lines = p.lines[:0]
 	var pos int
+	var moved bool
 	for _, v := range p.instructions {
-		if v.op == bytecode.OpLast+1 {
-			p.labels[v.arg.(string)] = pos
+		if v.op == pseudoInstructionLabel {
+			if p.labels[v.arg.(string)] != pos {
+				p.labels[v.arg.(string)] = pos
+				moved = true
+			}
 			continue
 		}
 		if v.op == bytecode.OpStore || v.op == bytecode.OpLoad {
 			i, ok := p.vars[v.arg.(string)]
 			if !ok {
-				return nil, 0, 0, errors.New("no such var: " + v.arg.(string))
+				return false, errors.New("no such var: " + v.arg.(string))
 			}
 			v.arg = int64(i)
 		}
+		if v.op == bytecode.OpMov {
+			var slots [2]int64
+			for i, name := range v.arg.([2]string) {
+				n, ok := p.vars[name]
+				if !ok {
+					return false, errors.New("no such var: " + name)
+				}
+				slots[i] = int64(n)
+			}
+			v.arg = slots
+		}
 		if isJump(v.op) || v.op == bytecode.OpCall {
 			label, ok := v.arg.(string)
 			if !ok {
-				return nil, 0, 0, errors.New("no label specified")
+				return false, errors.New("no label specified")
 			}
 			n, ok := p.labels[label]
 			if !ok {
-				return nil, 0, 0, fmt.Errorf("no such label: %s", label)
+				return false, fmt.Errorf("no such label: %s", label)
 			}
 			v.arg = int64(n)
 		}
 		n, err := bytecode.Encode(p.out, v.op, v.arg)
 		if err != nil {
-			return nil, 0, 0, err
+			return false, err
 		}
+		p.lines = append(p.lines, bytecode.LineInfo{Offset: pos, Line: v.line, Col: v.pos, File: v.file})
 		pos += n
 	}
-	if start, ok := p.labels["main"]; ok {
-		return p.out.Bytes(), start, len(p.vars), nil
-	}
-	return p.out.Bytes(), 0, len(p.vars), nil
+	return moved, nil
 }
 
 func isJump(op byte) bool {
@@ -163,55 +532,191 @@ func isJump(op byte) bool {
 }
 
 var imap = map[string]byte{
-	"nop":        bytecode.OpNOP,
-	"halt":       bytecode.OpHalt,
-	"push_int64": bytecode.OpPushInt64,
-	"push_uint8": bytecode.OpPushUint8,
-	"push_zero":  bytecode.OpPushZero,
-	"push_one":   bytecode.OpPushOne,
-	"store":      bytecode.OpStore,
-	"load":       bytecode.OpLoad,
-	"to_int64":   bytecode.OpToInt64,
-	"to_uint8":   bytecode.OpToUint8,
-	"print":      bytecode.OpPrint,
-	"print_ch":   bytecode.OpPrintCh,
-	"drop":       bytecode.OpDrop,
-	"dup":        bytecode.OpDup,
-	"swap":       bytecode.OpSwap,
-	"jump":       bytecode.OpJump,
-	"jump_true":  bytecode.OpJumpTrue,
-	"jump_false": bytecode.OpJumpTrue,
-	"jump_eq":    bytecode.OpJumpEq,
-	"jump_ne":    bytecode.OpJumpNotEq,
-	"jump_lt":    bytecode.OpJumpLT,
-	"jump_gt":    bytecode.OpJumpGT,
-	"add":        bytecode.OpAdd,
-	"sub":        bytecode.OpSub,
-	"mul":        bytecode.OpMul,
-	"div":        bytecode.OpDiv,
-	"inc":        bytecode.OpInc,
-	"dec":        bytecode.OpDec,
-	"mod":        bytecode.OpMod,
-	"and":        bytecode.OpAnd,
-	"or":         bytecode.OpOr,
-	"xor":        bytecode.OpXOR,
-	"not":        bytecode.OpNot,
-	"call":       bytecode.OpCall,
-	"ret":        bytecode.OpRet,
+	"nop":          bytecode.OpNOP,
+	"halt":         bytecode.OpHalt,
+	"push_int64":   bytecode.OpPushInt64,
+	"push_float64": bytecode.OpPushFloat64,
+	"push_uint64":  bytecode.OpPushUint64,
+	"push_uint8":   bytecode.OpPushUint8,
+	"push_zero":    bytecode.OpPushZero,
+	"push_one":     bytecode.OpPushOne,
+	"store":        bytecode.OpStore,
+	"load":         bytecode.OpLoad,
+	"mov":          bytecode.OpMov,
+	"create_array": bytecode.OpCreateArray,
+	"array_load":   bytecode.OpArrayLoad,
+	"array_store":  bytecode.OpArrayStore,
+	"to_int64":     bytecode.OpToInt64,
+	"to_float64":   bytecode.OpToFloat64,
+	"to_uint64":    bytecode.OpToUint64,
+	"to_uint8":     bytecode.OpToUint8,
+	"print":        bytecode.OpPrint,
+	"print_ch":     bytecode.OpPrintCh,
+	"drop":         bytecode.OpDrop,
+	"dup":          bytecode.OpDup,
+	"swap":         bytecode.OpSwap,
+	"jump":         bytecode.OpJump,
+	"jump_true":    bytecode.OpJumpTrue,
+	"jump_false":   bytecode.OpJumpFalse,
+	"jump_eq":      bytecode.OpJumpEq,
+	"jump_ne":      bytecode.OpJumpNotEq,
+	"jump_lt":      bytecode.OpJumpLT,
+	"jump_gt":      bytecode.OpJumpGT,
+	"add":          bytecode.OpAdd,
+	"sub":          bytecode.OpSub,
+	"mul":          bytecode.OpMul,
+	"div":          bytecode.OpDiv,
+	"inc":          bytecode.OpInc,
+	"dec":          bytecode.OpDec,
+	"mod":          bytecode.OpMod,
+	"and":          bytecode.OpAnd,
+	"or":           bytecode.OpOr,
+	"xor":          bytecode.OpXOR,
+	"not":          bytecode.OpNot,
+	"shl":          bytecode.OpShl,
+	"shr":          bytecode.OpShr,
+	"call":         bytecode.OpCall,
+	"ret":          bytecode.OpRet,
+	"print_str":    bytecode.OpPrintStr,
+	"read_byte":    bytecode.OpReadByte,
+	"read_int":     bytecode.OpReadInt,
+	"read_line":    bytecode.OpReadLine,
+	"enter":        bytecode.OpEnter,
+	"load_local":   bytecode.OpLoadLocal,
+	"store_local":  bytecode.OpStoreLocal,
 }
 
-func Compile(src io.Reader, dst io.Writer) error {
+// Symbols returns the labels and vars defined by the parsed source, labels
+// ordered by offset followed by vars ordered by slot. It is only meaningful
+// after Compile.
+func (p *Parser) Symbols() []bytecode.Symbol {
+	var labels, vars []bytecode.Symbol
+	for name, off := range p.labels {
+		labels = append(labels, bytecode.Symbol{Kind: bytecode.SymbolLabel, Value: off, Name: name})
+	}
+	for name, slot := range p.vars {
+		vars = append(vars, bytecode.Symbol{Kind: bytecode.SymbolVar, Value: slot, Name: name})
+	}
+	for _, syms := range [][]bytecode.Symbol{labels, vars} {
+		sort.Slice(syms, func(i, j int) bool {
+			if syms[i].Value != syms[j].Value {
+				return syms[i].Value < syms[j].Value
+			}
+			return syms[i].Name < syms[j].Name
+		})
+	}
+	return append(labels, vars...)
+}
+
+// Lines returns the source position of every instruction, in offset order.
+// It is only meaningful after Compile.
+func (p *Parser) Lines() []bytecode.LineInfo {
+	return append([]bytecode.LineInfo(nil), p.lines...)
+}
+
+// Data returns the initial values of the vars declared with one, in slot order.
+func (p *Parser) Data() []bytecode.DataInit {
+	return append([]bytecode.DataInit(nil), p.data...)
+}
+
+// Files returns the names of the files included by the parsed source, in
+// the order they were included. LineInfo.File numbers them from 1.
+func (p *Parser) Files() []string {
+	return append([]string(nil), p.files[1:]...)
+}
+
+// Options control how source is assembled.
+type Options struct {
+	File  string // name of the source file, recorded in debug info
+	Debug bool   // include symbols and a line map in the image
+}
+
+// Assemble parses and compiles src into an image.
+func Assemble(src io.Reader, opts Options) (*bytecode.Image, error) {
 	parser := NewParser(NewLexer(src))
+	parser.files[0] = opts.File
 	if err := parser.Parse(); err != nil {
-		return err
+		return nil, err
 	}
 	code, start, dataElements, err := parser.Compile()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	img := &bytecode.Image{
+		Version:      bytecode.Version,
+		Start:        start,
+		DataElements: dataElements,
+		Code:         code,
+		Data:         parser.Data(),
+	}
+	if opts.Debug {
+		img.Symbols = parser.Symbols()
+		img.Debug = &bytecode.DebugInfo{File: opts.File, Files: parser.Files(), Lines: parser.Lines()}
+	}
+	return img, nil
+}
+
+// Object returns the parsed source as a relocatable object. Unlike Compile,
+// it allows branches, loads and stores to name labels and vars the source
+// does not define, leaving them to be resolved by the linker against those
+// exported by other objects.
+func (p *Parser) Object() (*bytecode.Object, error) {
+	if err := p.diags.Err(); err != nil {
+		return nil, err
+	}
+	obj := &bytecode.Object{Files: append([]string(nil), p.files...)}
+	exported := make(map[string]bool)
+	for _, e := range p.exports {
+		exported[e.name.Value] = true
 	}
-	if _, err := bytecode.WriteHeader(dst, start, dataElements); err != nil {
+	obj.Vars = make([]bytecode.ObjectVar, len(p.vars))
+	for name, slot := range p.vars {
+		obj.Vars[slot] = bytecode.ObjectVar{Name: name, Export: exported[name]}
+	}
+	for _, d := range p.data {
+		c := d.Value
+		obj.Vars[d.Slot].Init = &c
+	}
+	for _, ins := range p.instructions {
+		if ins.op == pseudoInstructionLabel {
+			name := ins.arg.(string)
+			obj.Labels = append(obj.Labels, bytecode.ObjectLabel{Name: name, Index: len(obj.Instructions), Export: exported[name]})
+			continue
+		}
+		oi := bytecode.ObjectInstruction{Op: ins.op, Line: ins.line, Col: ins.pos, File: ins.file}
+		switch arg := ins.arg.(type) {
+		case string:
+			oi.Refs = []string{arg}
+		case [2]string:
+			oi.Refs = []string{arg[0], arg[1]}
+		default:
+			oi.Arg = arg
+		}
+		obj.Instructions = append(obj.Instructions, oi)
+	}
+	return obj, nil
+}
+
+// AssembleObject parses src into a relocatable object.
+func AssembleObject(src io.Reader, opts Options) (*bytecode.Object, error) {
+	parser := NewParser(NewLexer(src))
+	parser.files[0] = opts.File
+	if err := parser.Parse(); err != nil {
+		return nil, err
+	}
+	return parser.Object()
+}
+
+// Compile assembles src and writes the image to dst.
+func Compile(src io.Reader, dst io.Writer) error {
+	return CompileOptions(src, dst, Options{})
+}
+
+// CompileOptions is like Compile but assembles according to opts.
+func CompileOptions(src io.Reader, dst io.Writer, opts Options) error {
+	img, err := Assemble(src, opts)
+	if err != nil {
 		return err
 	}
-	_, err = dst.Write(code)
-	return err
+	return bytecode.WriteImage(dst, img)
 }
@@ -0,0 +1,349 @@
+package asm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+func TestAssembleData(t *testing.T) {
+	img, err := Assemble(strings.NewReader(`
+var counter
+var greeting "hi\n"
+var table 1, -2, 3
+var answer 42
+:main
+	halt
+`), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u8 := func(b byte) bytecode.Constant { return bytecode.Constant{Kind: bytecode.ConstUint8, Int: int64(b)} }
+	i64 := func(n int64) bytecode.Constant { return bytecode.Constant{Kind: bytecode.ConstInt64, Int: n} }
+	expected := []bytecode.DataInit{
+		{Slot: 1, Value: bytecode.Constant{Kind: bytecode.ConstArray, Elems: []bytecode.Constant{u8('h'), u8('i'), u8('\n')}}},
+		{Slot: 2, Value: bytecode.Constant{Kind: bytecode.ConstArray, Elems: []bytecode.Constant{i64(1), i64(-2), i64(3)}}},
+		{Slot: 3, Value: i64(42)},
+	}
+	if img.DataElements != 4 || !reflect.DeepEqual(img.Data, expected) {
+		t.Errorf("expecting 4 data elements initialised with %+v, got %d with %+v", expected, img.DataElements, img.Data)
+	}
+
+	for i, src := range []string{
+		"var t 1,\n:main\n\thalt\n",
+		"var t 1, \"a\"\n:main\n\thalt\n",
+		"var s \"abc\n:main\n\thalt\n",
+	} {
+		if _, err := Assemble(strings.NewReader(src), Options{}); err == nil {
+			t.Errorf("%d. expecting an error assembling %q", i, src)
+		}
+	}
+}
+
+func TestAssembleFloats(t *testing.T) {
+	img, err := Assemble(strings.NewReader(`
+.const HALF 0.5
+var scale 2.5
+var mixed 1, HALF, -3e2
+:main
+	push_float64 HALF
+	push_float64 2
+	halt
+`), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i64 := func(n int64) bytecode.Constant { return bytecode.Constant{Kind: bytecode.ConstInt64, Int: n} }
+	f64 := func(f float64) bytecode.Constant { return bytecode.Constant{Kind: bytecode.ConstFloat64, Float: f} }
+	expectedData := []bytecode.DataInit{
+		{Slot: 0, Value: f64(2.5)},
+		{Slot: 1, Value: bytecode.Constant{Kind: bytecode.ConstArray, Elems: []bytecode.Constant{i64(1), f64(0.5), f64(-300)}}},
+	}
+	if !reflect.DeepEqual(img.Data, expectedData) {
+		t.Errorf("expecting data %+v, got %+v", expectedData, img.Data)
+	}
+	expected := []byte{
+		bytecode.OpPushFloat64, 0, 0, 0, 0, 0, 0, 0xe0, 0x3f,
+		bytecode.OpPushFloat64, 0, 0, 0, 0, 0, 0, 0, 0x40,
+		bytecode.OpHalt,
+	}
+	if !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %x, got %x", expected, img.Code)
+	}
+
+	for i, tt := range []struct {
+		src, expected string
+	}{
+		{":main\n\tpush_float64 x\n", "invalid float64 at line 2 pos 2"},
+		{":main\n\tpush_int64 1.5\n", "invalid int64 at line 2 pos 2"},
+		{"var t 1, \"a\"\n:main\n\thalt\n", "expecting number after comma at line 1 pos 10"},
+	} {
+		if _, err := Assemble(strings.NewReader(tt.src), Options{}); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+}
+
+func TestAssembleUint64(t *testing.T) {
+	img, err := Assemble(strings.NewReader(":main\n\tpush_uint64 0xffff_ffff_ffff_ffff\n\tpush_uint64 300\n\tshl\n\tto_uint64\n\tshr\n\thalt\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		bytecode.OpPushUint64, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+		bytecode.OpPushUint64, 0xac, 0x02,
+		bytecode.OpShl, bytecode.OpToUint64, bytecode.OpShr, bytecode.OpHalt,
+	}
+	if !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %x, got %x", expected, img.Code)
+	}
+
+	for i, tt := range []struct {
+		src, expected string
+	}{
+		{":main\n\tpush_uint64 -1\n", "invalid uint64 at line 2 pos 2"},
+		{":main\n\tpush_uint64 1.5\n", "invalid uint64 at line 2 pos 2"},
+		{":main\n\tpush_int64 0xffff_ffff_ffff_ffff\n", "invalid int64 at line 2 pos 2"},
+	} {
+		if _, err := Assemble(strings.NewReader(tt.src), Options{}); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+}
+
+func TestAssembleLiterals(t *testing.T) {
+	img, err := Assemble(strings.NewReader(":main\n\tpush_uint8 'A' # letter\n\tpush_int64 0x10\n\tpush_uint8 0b1111_1111\n\thalt\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{bytecode.OpPushUint8, 'A', bytecode.OpPushInt64, 0x20, bytecode.OpPushUint8, 0xff, bytecode.OpHalt}
+	if !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %x, got %x", expected, img.Code)
+	}
+
+	for i, tt := range []struct {
+		src, expected string
+	}{
+		{":main\n\tpush_uint8 0x100\n", "invalid uint8 at line 2 pos 2"},
+		{":main\n\tpush_uint8 'ab'\n", "character literal has more than one character at line 2 pos 13"},
+		{":main\n\tpush_int64", "unexpected end of input after push_int64 at line 2 pos 2"},
+	} {
+		if _, err := Assemble(strings.NewReader(tt.src), Options{}); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	src := `
+.const LIMIT 3
+.const NEWLINE '\n'
+.macro countdown from
+	push_int64 from
+:loop
+	dec
+	dup
+	jump_true loop
+	drop
+.endm
+.macro newline
+	push_uint8 NEWLINE
+	print_ch
+.endm
+:main
+	countdown LIMIT
+	countdown 0x10
+	newline
+	halt
+`
+	img, err := Assemble(strings.NewReader(src), Options{Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		bytecode.OpPushInt64, 6, bytecode.OpDec, bytecode.OpDup, bytecode.OpJumpTrue, 4, bytecode.OpDrop,
+		bytecode.OpPushInt64, 0x20, bytecode.OpDec, bytecode.OpDup, bytecode.OpJumpTrue, 18, bytecode.OpDrop,
+		bytecode.OpPushUint8, '\n', bytecode.OpPrintCh, bytecode.OpHalt,
+	}
+	if !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %v, got %v", expected, img.Code)
+	}
+	var labels []string
+	for _, sym := range img.Symbols {
+		if sym.Kind == bytecode.SymbolLabel {
+			labels = append(labels, sym.Name)
+		}
+	}
+	if want := []string{"main", "countdown.1.loop", "countdown.2.loop"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("expecting labels %v, got %v", want, labels)
+	}
+	if l := img.Debug.Lines[8]; l.Line != 18 {
+		t.Errorf("expecting expanded instructions to take the line of the invocation, got %+v", l)
+	}
+
+	// Same-line checks in the body see the body's lines, not the invocation's.
+	img, err = Assemble(strings.NewReader(`
+.macro getter name slot
+.func name locals=1
+	load_local slot
+	ret
+.endm
+getter first 0
+:main
+	call first
+	halt
+`), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []byte{bytecode.OpEnter, 0, 2, bytecode.OpLoadLocal, 0, bytecode.OpRet, bytecode.OpCall, 0, bytecode.OpHalt}
+	if !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %v, got %v", expected, img.Code)
+	}
+
+	for i, tt := range []struct {
+		src, expected string
+	}{
+		{".const X 1\n.const X 2\n", "constant X already defined at line 2 pos 8"},
+		{".const halt 1\n", "halt is an instruction at line 1 pos 8"},
+		{".const X y\n", "expecting numeric value for constant X at line 1 pos 10"},
+		{".macro m\n\tdup\n", "macro without .endm at line 1 pos 1"},
+		{".macro m\n.macro n\n.endm\n", "nested macro definition at line 2 pos 1 (and 1 more error)"},
+		{".endm\n", ".endm without .macro at line 1 pos 1"},
+		{".frob\n", "unknown directive .frob at line 1 pos 1"},
+		{".macro m\n\tm\n.endm\n:main\n\tm\n", "too many expansions of macro m, is it recursive? at line 5 pos 2"},
+		{".macro m a\n\tpush_int64 a\n.endm\n:main\n\tm", "unexpected end of input after m at line 5 pos 2"},
+		{".macro m a b\n\tpush_int64 a\n.endm\n:main\n\tm 1\n\thalt\n", "expecting argument b to macro m at line 5 pos 2"},
+		{".macro m a\n\tpush_int64 a\n.endm\n:main\n\tm ,\n\thalt\n", "expecting argument a to macro m at line 5 pos 2"},
+	} {
+		if _, err := Assemble(strings.NewReader(tt.src), Options{}); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lil-include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.asm":       ".include \"lib/util.asm\"\n:main\n\tcall twice\n\thalt\n",
+		"lib/util.asm":   ".include \"consts.asm\"\n:twice\n\tpush_int64 N\n\tdup\n\tadd\n\tret\n",
+		"lib/consts.asm": ".const N 21\n",
+		"cycle.asm":      ".include \"lib/cycle.asm\"\n",
+		"lib/cycle.asm":  "\n.include \"../cycle.asm\"\n",
+		"bad.asm":        ".include \"lib/bad.asm\"\n:main\n\thalt\n",
+		"lib/bad.asm":    "\tdup\n\tfrob\n",
+	}
+	if err := os.Mkdir(filepath.Join(dir, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assemble := func(name string) (*bytecode.Image, error) {
+		path := filepath.Join(dir, name)
+		return Assemble(strings.NewReader(files[name]), Options{File: path, Debug: true})
+	}
+
+	img, err := assemble("main.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{bytecode.OpPushInt64, 42, bytecode.OpDup, bytecode.OpAdd, bytecode.OpRet, bytecode.OpCall, 0, bytecode.OpHalt}
+	if !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %v, got %v", expected, img.Code)
+	}
+	util := filepath.Join(dir, "lib", "util.asm")
+	if want := []string{util, filepath.Join(dir, "lib", "consts.asm")}; !reflect.DeepEqual(img.Debug.Files, want) {
+		t.Errorf("expecting included files %v, got %v", want, img.Debug.Files)
+	}
+	if l := img.Debug.Lines[0]; img.Debug.FileName(l) != util || l.Line != 3 {
+		t.Errorf("expecting first instruction at %s:3, got %s:%d", util, img.Debug.FileName(l), l.Line)
+	}
+	if l := img.Debug.Lines[4]; l.File != 0 || l.Line != 3 {
+		t.Errorf("expecting call at line 3 of the main file, got %+v", l)
+	}
+
+	for i, tt := range []struct {
+		name, expected string
+	}{
+		{"cycle.asm", filepath.Join(dir, "lib", "cycle.asm") + ": include cycle " +
+			filepath.Join(dir, "cycle.asm") + " -> " + filepath.Join(dir, "lib", "cycle.asm") + " -> " +
+			filepath.Join(dir, "cycle.asm") + " at line 2 pos 1"},
+		{"bad.asm", filepath.Join(dir, "lib", "bad.asm") + ": invalid instruction at line 2 pos 2"},
+	} {
+		if _, err := assemble(tt.name); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+}
+
+func TestAssembleJumpFalse(t *testing.T) {
+	img, err := Assemble(strings.NewReader(":main\n\tpush_zero\n\tjump_false main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{bytecode.OpPushZero, bytecode.OpJumpFalse, 0}; !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %v, got %v", expected, img.Code)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	src := `
+.const N 2
+.func add args=N locals=1
+	load_local 0
+	load_local 1
+	add
+	store_local 2
+	load_local 2
+	ret
+.func main
+	push_one
+	push_one
+	call add
+	halt
+`
+	img, err := Assemble(strings.NewReader(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		bytecode.OpEnter, 4, 2, bytecode.OpLoadLocal, 0, bytecode.OpLoadLocal, 2, bytecode.OpAdd,
+		bytecode.OpStoreLocal, 4, bytecode.OpLoadLocal, 4, bytecode.OpRet,
+		bytecode.OpEnter, 0, 0, bytecode.OpPushOne, bytecode.OpPushOne, bytecode.OpCall, 0, bytecode.OpHalt,
+	}
+	if !reflect.DeepEqual(img.Code, expected) {
+		t.Errorf("expecting code %v, got %v", expected, img.Code)
+	}
+	if img.Start != 13 {
+		t.Errorf("expecting start at 13, got %d", img.Start)
+	}
+
+	for i, tt := range []struct {
+		src, expected string
+	}{
+		{":main\n\tload_local 0\n", "load_local outside of a .func at line 2 pos 2"},
+		{".func f args=1 locals=1\n\tstore_local 2\n", "local 2 out of range, function f has 2 at line 2 pos 2"},
+		{".func f args=x\n", "invalid args count \"x\" at line 1 pos 9"},
+		{".func f stack=1\n", "unknown .func setting stack at line 1 pos 9"},
+		{".func f 2\n", "expecting args=N or locals=N at line 1 pos 9"},
+		{".func\n\thalt\n", "expecting function name at line 1 pos 1"},
+		{":f\n.func f\n", "label f already defined at line 2 pos 7"},
+		{":f\n\tenter 0 1\n\tload_local 1\n", "local 1 out of range, function f has 1 at line 3 pos 2"},
+	} {
+		if _, err := Assemble(strings.NewReader(tt.src), Options{}); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -47,6 +50,19 @@ const (
 	OpNot
 	OpCall
 	OpRet
+	OpReadByte
+	OpReadInt
+	OpReadLine
+	OpPrintStr
+	OpEnter
+	OpLoadLocal
+	OpStoreLocal
+	OpPushFloat64
+	OpToFloat64
+	OpPushUint64
+	OpToUint64
+	OpShl
+	OpShr
 	OpLast // Keep this as the final code in the list.
 )
 
@@ -63,20 +79,38 @@ func WriteHeader(w io.Writer, start, dataElements int) (int, error) {
 	return written, nil
 }
 
-var ErrInvalidArgument = errors.New("invalid argument")
+func ReadHeader(b []byte) (start, dataElements, size int, err error) {
+	var vals [2]int
+	for i := range vals {
+		n, read := binary.Varint(b[size:])
+		if read <= 0 {
+			return 0, 0, 0, ErrInvalidHeader
+		}
+		vals[i] = int(n)
+		size += read
+	}
+	return vals[0], vals[1], size, nil
+}
+
+var (
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrInvalidHeader   = errors.New("invalid header")
+	ErrTruncated       = errors.New("truncated instruction")
+	ErrUnknownOp       = errors.New("no such op code")
+)
 
 func Encode(w io.Writer, op byte, arg interface{}) (int, error) {
 	ins, ok := imap[op]
 	if !ok {
 		return 0, fmt.Errorf("no such op code: %d", op)
 	}
-	switch ins.arg {
-	case argNone:
+	switch ins.Arg {
+	case ArgNone:
 		if arg != nil {
-			return 0, fmt.Errorf("op code %s has no arguments but one was specified", ins.name)
+			return 0, fmt.Errorf("op code %s has no arguments but one was specified", ins.Name)
 		}
 		return w.Write([]byte{op})
-	case argInt:
+	case ArgInt:
 		n, ok := arg.(int64)
 		if !ok {
 			return 0, ErrInvalidArgument
@@ -87,62 +121,200 @@ func Encode(w io.Writer, op byte, arg interface{}) (int, error) {
 		b = append(b, op)
 		b = append(b, buf[:size]...)
 		return w.Write(b)
-	case argUint:
+	case ArgUint:
 		n, ok := arg.(uint8)
 		if !ok {
 			return 0, ErrInvalidArgument
 		}
 		return w.Write([]byte{op, byte(n)})
+	case ArgIntPair:
+		pair, ok := arg.([2]int64)
+		if !ok {
+			return 0, ErrInvalidArgument
+		}
+		b := make([]byte, 0, 1+2*binary.MaxVarintLen64)
+		b = append(b, op)
+		for _, n := range pair {
+			buf := make([]byte, binary.MaxVarintLen64)
+			size := binary.PutVarint(buf, n)
+			b = append(b, buf[:size]...)
+		}
+		return w.Write(b)
+	case ArgFloat:
+		f, ok := arg.(float64)
+		if !ok {
+			return 0, ErrInvalidArgument
+		}
+		b := []byte{op, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(b[1:], math.Float64bits(f))
+		return w.Write(b)
+	case ArgUint64:
+		n, ok := arg.(uint64)
+		if !ok {
+			return 0, ErrInvalidArgument
+		}
+		b := make([]byte, 1+binary.MaxVarintLen64)
+		b[0] = op
+		size := binary.PutUvarint(b[1:], n)
+		return w.Write(b[:1+size])
+	}
+	// should be unreachable
+	return 0, fmt.Errorf("invalid instruction argument type: %d", ins.Arg)
+}
+
+// Decode decodes the instruction at the start of code, returning its op code, argument
+// (of the same type Encode accepts) and encoded length.
+func Decode(code []byte) (op byte, arg interface{}, size int, err error) {
+	if len(code) == 0 {
+		return 0, nil, 0, ErrTruncated
+	}
+	op = code[0]
+	ins, ok := imap[op]
+	if !ok {
+		return 0, nil, 0, fmt.Errorf("%w: %d", ErrUnknownOp, op)
+	}
+	switch ins.Arg {
+	case ArgNone:
+		return op, nil, 1, nil
+	case ArgInt:
+		n, read := binary.Varint(code[1:])
+		if read <= 0 {
+			return 0, nil, 0, ErrTruncated
+		}
+		return op, n, 1 + read, nil
+	case ArgUint:
+		if len(code) < 2 {
+			return 0, nil, 0, ErrTruncated
+		}
+		return op, code[1], 2, nil
+	case ArgIntPair:
+		var pair [2]int64
+		size = 1
+		for i := range pair {
+			n, read := binary.Varint(code[size:])
+			if read <= 0 {
+				return 0, nil, 0, ErrTruncated
+			}
+			pair[i] = n
+			size += read
+		}
+		return op, pair, size, nil
+	case ArgFloat:
+		if len(code) < 9 {
+			return 0, nil, 0, ErrTruncated
+		}
+		return op, math.Float64frombits(binary.LittleEndian.Uint64(code[1:9])), 9, nil
+	case ArgUint64:
+		n, read := binary.Uvarint(code[1:])
+		if read <= 0 {
+			return 0, nil, 0, ErrTruncated
+		}
+		return op, n, 1 + read, nil
 	}
 	// should be unreachable
-	return 0, fmt.Errorf("invalid instruction argument type: %d", ins.arg)
+	return 0, nil, 0, fmt.Errorf("invalid instruction argument type: %d", ins.Arg)
 }
 
+// FormatFloat formats f as the shortest decimal that parses back to f,
+// including a decimal point or exponent so that it reads as a float literal.
+func FormatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// Argument kinds.
 const (
-	argNone = iota
-	argInt
-	argUint
+	ArgNone = iota
+	ArgInt
+	ArgUint
+	ArgIntPair
+	ArgFloat  // eight bytes, the little endian IEEE 754 bits of a float64
+	ArgUint64 // unsigned varint
 )
 
-type instruction struct {
-	name string
-	arg  int
+// Instruction describes an op code: its assembler mnemonic, the kind of argument
+// it takes and how many operand stack values it pops and pushes.
+type Instruction struct {
+	Name   string
+	Arg    int
+	Pops   int
+	Pushes int
+}
+
+// Lookup returns the description of op, reporting whether op is a known op code.
+func Lookup(op byte) (Instruction, bool) {
+	ins, ok := imap[op]
+	return ins, ok
+}
+
+// IsBranch reports whether op takes a code offset as its argument.
+func IsBranch(op byte) bool {
+	switch op {
+	case OpJump, OpJumpTrue, OpJumpFalse, OpJumpEq, OpJumpNotEq, OpJumpLT, OpJumpGT, OpCall:
+		return true
+	}
+	return false
+}
+
+// IsConditional reports whether op is a branch that may or may not be taken.
+func IsConditional(op byte) bool {
+	return IsBranch(op) && op != OpJump && op != OpCall
 }
 
-var imap = map[byte]instruction{
-	OpNOP:       {"nop", argNone},
-	OpHalt:      {"halt", argNone},
-	OpPushInt64: {"push_int64", argInt},
-	OpPushUint8: {"push_uint8", argUint},
-	OpPushZero:  {"push_zero", argNone},
-	OpPushOne:   {"push_one", argNone},
-	OpStore:     {"store", argInt},
-	OpLoad:      {"load", argInt},
-	OpToInt64:   {"to_int64", argNone},
-	OpToUint8:   {"to_uint8", argNone},
-	OpPrint:     {"print", argNone},
-	OpPrintCh:   {"print_ch", argNone},
-	OpDrop:      {"drop", argNone},
-	OpDup:       {"dup", argNone},
-	OpSwap:      {"swap", argNone},
-	OpJump:      {"jump", argInt},
-	OpJumpTrue:  {"jump_true", argInt},
-	OpJumpFalse: {"jump_false", argInt},
-	OpJumpEq:    {"jump_eq", argInt},
-	OpJumpNotEq: {"jump_ne", argInt},
-	OpJumpLT:    {"jump_lt", argInt},
-	OpJumpGT:    {"jump_gt", argInt},
-	OpAdd:       {"add", argNone},
-	OpSub:       {"sub", argNone},
-	OpMul:       {"mul", argNone},
-	OpDiv:       {"div", argNone},
-	OpInc:       {"inc", argNone},
-	OpDec:       {"dec", argNone},
-	OpMod:       {"mod", argNone},
-	OpAnd:       {"and", argNone},
-	OpOr:        {"or", argNone},
-	OpXOR:       {"xor", argNone},
-	OpNot:       {"not", argNone},
-	OpCall:      {"call", argInt},
-	OpRet:       {"ret", argNone},
+var imap = map[byte]Instruction{
+	OpNOP:         {"nop", ArgNone, 0, 0},
+	OpHalt:        {"halt", ArgNone, 0, 0},
+	OpPushInt64:   {"push_int64", ArgInt, 0, 1},
+	OpPushUint8:   {"push_uint8", ArgUint, 0, 1},
+	OpPushZero:    {"push_zero", ArgNone, 0, 1},
+	OpPushOne:     {"push_one", ArgNone, 0, 1},
+	OpStore:       {"store", ArgInt, 1, 0},
+	OpLoad:        {"load", ArgInt, 0, 1},
+	OpMov:         {"mov", ArgIntPair, 0, 0},
+	OpCreateArray: {"create_array", ArgNone, 1, 1},
+	OpArrayLoad:   {"array_load", ArgNone, 2, 1},
+	OpArrayStore:  {"array_store", ArgNone, 3, 0},
+	OpToInt64:     {"to_int64", ArgNone, 1, 1},
+	OpToUint8:     {"to_uint8", ArgNone, 1, 1},
+	OpPrint:       {"print", ArgNone, 1, 0},
+	OpPrintCh:     {"print_ch", ArgNone, 1, 0},
+	OpDrop:        {"drop", ArgNone, 1, 0},
+	OpDup:         {"dup", ArgNone, 1, 2},
+	OpSwap:        {"swap", ArgNone, 2, 2},
+	OpJump:        {"jump", ArgInt, 0, 0},
+	OpJumpTrue:    {"jump_true", ArgInt, 1, 0},
+	OpJumpFalse:   {"jump_false", ArgInt, 1, 0},
+	OpJumpEq:      {"jump_eq", ArgInt, 2, 0},
+	OpJumpNotEq:   {"jump_ne", ArgInt, 2, 0},
+	OpJumpLT:      {"jump_lt", ArgInt, 2, 0},
+	OpJumpGT:      {"jump_gt", ArgInt, 2, 0},
+	OpAdd:         {"add", ArgNone, 2, 1},
+	OpSub:         {"sub", ArgNone, 2, 1},
+	OpMul:         {"mul", ArgNone, 2, 1},
+	OpDiv:         {"div", ArgNone, 2, 1},
+	OpInc:         {"inc", ArgNone, 1, 1},
+	OpDec:         {"dec", ArgNone, 1, 1},
+	OpMod:         {"mod", ArgNone, 2, 1},
+	OpAnd:         {"and", ArgNone, 2, 1},
+	OpOr:          {"or", ArgNone, 2, 1},
+	OpXOR:         {"xor", ArgNone, 2, 1},
+	OpNot:         {"not", ArgNone, 1, 1},
+	OpCall:        {"call", ArgInt, 0, 0},
+	OpRet:         {"ret", ArgNone, 0, 0},
+	OpReadByte:    {"read_byte", ArgNone, 0, 1}, // the byte, or int64 -1 at the end of input
+	OpReadInt:     {"read_int", ArgNone, 0, 2},  // the integer and 1, or 0 and 0 if the input ends or is not a number
+	OpReadLine:    {"read_line", ArgNone, 0, 2}, // the line and 1, or an empty array and 0 at the end of input
+	OpPrintStr:    {"print_str", ArgNone, 1, 0},
+	OpEnter:       {"enter", ArgIntPair, 0, 0}, // pops its first argument
+	OpLoadLocal:   {"load_local", ArgInt, 0, 1},
+	OpStoreLocal:  {"store_local", ArgInt, 1, 0},
+	OpPushFloat64: {"push_float64", ArgFloat, 0, 1},
+	OpToFloat64:   {"to_float64", ArgNone, 1, 1},
+	OpPushUint64:  {"push_uint64", ArgUint64, 0, 1},
+	OpToUint64:    {"to_uint64", ArgNone, 1, 1},
+	OpShl:         {"shl", ArgNone, 2, 1},
+	OpShr:         {"shr", ArgNone, 2, 1},
 }
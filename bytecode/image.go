@@ -0,0 +1,353 @@
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// An image starts with Magic and a uvarint format version, followed by the
+// uvarint start offset and number of data slots. The rest of the image is a
+// sequence of sections, each a section ID byte, a uvarint payload length and
+// the payload. Images without Magic use the legacy layout written by
+// WriteHeader: two varints followed by the code.
+var Magic = []byte("\x7fLIL")
+
+// Version is the image format version written by WriteImage. Version 2 added
+// included source files to the debug section.
+const Version = 2
+
+// Section IDs.
+const (
+	SectionCode byte = iota + 1
+	SectionData
+	SectionConstants
+	SectionSymbols
+	SectionDebug
+)
+
+// Constant kinds.
+const (
+	ConstInt64 byte = iota + 1
+	ConstUint8
+	ConstArray
+	ConstFloat64
+)
+
+// Constant is a value stored in an image.
+type Constant struct {
+	Kind  byte
+	Int   int64      // value of ConstInt64 and ConstUint8
+	Float float64    // value of ConstFloat64
+	Elems []Constant // elements of ConstArray
+}
+
+// DataInit initialises a data slot when the image is loaded.
+type DataInit struct {
+	Slot  int
+	Value Constant
+}
+
+// Symbol kinds.
+const (
+	SymbolLabel byte = iota + 1
+	SymbolVar
+)
+
+// Symbol names a code offset (SymbolLabel) or data slot (SymbolVar).
+type Symbol struct {
+	Kind  byte
+	Value int
+	Name  string
+}
+
+// LineInfo maps the instruction at Offset to its position in the source.
+type LineInfo struct {
+	Offset int
+	Line   int
+	Col    int
+	File   int // 0 for DebugInfo.File, otherwise one more than an index into DebugInfo.Files
+}
+
+// DebugInfo maps code offsets back to the source files they were assembled from.
+type DebugInfo struct {
+	File  string   // the file that was assembled
+	Files []string // other files whose code it contains
+	Lines []LineInfo
+}
+
+// FileName returns the name of the source file of l.
+func (d *DebugInfo) FileName(l LineInfo) string {
+	if l.File > 0 && l.File <= len(d.Files) {
+		return d.Files[l.File-1]
+	}
+	return d.File
+}
+
+// Image is a decoded program image.
+type Image struct {
+	Version      int // 0 for legacy images
+	Start        int
+	DataElements int
+	Code         []byte
+	Data         []DataInit
+	Constants    []Constant
+	Symbols      []Symbol
+	Debug        *DebugInfo
+}
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported image version")
+	ErrInvalidImage       = errors.New("invalid image")
+)
+
+// ReadImage reads an image in either the current or the legacy layout.
+func ReadImage(r io.Reader) (*Image, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseImage(b)
+}
+
+// ParseImage decodes an image in either the current or the legacy layout.
+// Unknown sections are skipped.
+func ParseImage(b []byte) (*Image, error) {
+	if !bytes.HasPrefix(b, Magic) {
+		start, dataElements, size, err := ReadHeader(b)
+		if err != nil {
+			return nil, err
+		}
+		return &Image{Start: start, DataElements: dataElements, Code: b[size:]}, nil
+	}
+	d := decoder{b: b[len(Magic):]}
+	img := &Image{Version: d.int()}
+	if d.err == nil && (img.Version < 1 || img.Version > Version) {
+		return nil, fmt.Errorf("%w: %d (supported up to %d)", ErrUnsupportedVersion, img.Version, Version)
+	}
+	img.Start = d.int()
+	img.DataElements = d.int()
+	for d.err == nil && len(d.b) > 0 {
+		id := d.byte()
+		s := decoder{b: d.bytes()}
+		switch id {
+		case SectionCode:
+			img.Code = s.b
+		case SectionData:
+			for n := s.int(); n > 0 && s.err == nil; n-- {
+				img.Data = append(img.Data, DataInit{Slot: s.int(), Value: s.constant()})
+			}
+		case SectionConstants:
+			for n := s.int(); n > 0 && s.err == nil; n-- {
+				img.Constants = append(img.Constants, s.constant())
+			}
+		case SectionSymbols:
+			for n := s.int(); n > 0 && s.err == nil; n-- {
+				img.Symbols = append(img.Symbols, Symbol{Kind: s.byte(), Value: s.int(), Name: s.string()})
+			}
+		case SectionDebug:
+			img.Debug = &DebugInfo{File: s.string()}
+			if img.Version >= 2 {
+				for n := s.int(); n > 0 && s.err == nil; n-- {
+					img.Debug.Files = append(img.Debug.Files, s.string())
+				}
+			}
+			for n := s.int(); n > 0 && s.err == nil; n-- {
+				l := LineInfo{Offset: s.int(), Line: s.int(), Col: s.int()}
+				if img.Version >= 2 {
+					l.File = s.int()
+				}
+				img.Debug.Lines = append(img.Debug.Lines, l)
+			}
+		}
+		if s.err != nil {
+			d.err = s.err
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return img, nil
+}
+
+// WriteImage writes img in the current layout. Empty sections are omitted.
+func WriteImage(w io.Writer, img *Image) error {
+	var e encoder
+	e.buf.Write(Magic)
+	e.int(Version)
+	e.int(img.Start)
+	e.int(img.DataElements)
+	var s encoder
+	s.buf.Write(img.Code)
+	e.section(SectionCode, &s)
+	if len(img.Data) > 0 {
+		s.int(len(img.Data))
+		for _, d := range img.Data {
+			s.int(d.Slot)
+			s.constant(d.Value)
+		}
+		e.section(SectionData, &s)
+	}
+	if len(img.Constants) > 0 {
+		s.int(len(img.Constants))
+		for _, c := range img.Constants {
+			s.constant(c)
+		}
+		e.section(SectionConstants, &s)
+	}
+	if len(img.Symbols) > 0 {
+		s.int(len(img.Symbols))
+		for _, sym := range img.Symbols {
+			s.buf.WriteByte(sym.Kind)
+			s.int(sym.Value)
+			s.string(sym.Name)
+		}
+		e.section(SectionSymbols, &s)
+	}
+	if img.Debug != nil {
+		s.string(img.Debug.File)
+		s.int(len(img.Debug.Files))
+		for _, f := range img.Debug.Files {
+			s.string(f)
+		}
+		s.int(len(img.Debug.Lines))
+		for _, l := range img.Debug.Lines {
+			s.int(l.Offset)
+			s.int(l.Line)
+			s.int(l.Col)
+			s.int(l.File)
+		}
+		e.section(SectionDebug, &s)
+	}
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) int(n int) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
+
+func (e *encoder) string(s string) {
+	e.int(len(s))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) constant(c Constant) {
+	e.buf.WriteByte(c.Kind)
+	switch c.Kind {
+	case ConstInt64:
+		var b [binary.MaxVarintLen64]byte
+		e.buf.Write(b[:binary.PutVarint(b[:], c.Int)])
+	case ConstUint8:
+		e.buf.WriteByte(byte(c.Int))
+	case ConstArray:
+		e.int(len(c.Elems))
+		for _, el := range c.Elems {
+			e.constant(el)
+		}
+	case ConstFloat64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(c.Float))
+		e.buf.Write(b[:])
+	}
+}
+
+// section writes s as a section payload and resets s for reuse.
+func (e *encoder) section(id byte, s *encoder) {
+	e.buf.WriteByte(id)
+	e.int(s.buf.Len())
+	e.buf.Write(s.buf.Bytes())
+	s.buf.Reset()
+}
+
+// decoder reads from b, recording the first error encountered. Once an error
+// has occurred every read returns a zero value.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrInvalidImage
+	}
+	d.b = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) == 0 {
+		d.fail()
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) int() int {
+	n, size := binary.Uvarint(d.b)
+	if size <= 0 || n > math.MaxInt32 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[size:]
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int()
+	if n > len(d.b) {
+		d.fail()
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) string() string { return string(d.bytes()) }
+
+func (d *decoder) constant() Constant {
+	c := Constant{Kind: d.byte()}
+	switch c.Kind {
+	case ConstInt64:
+		n, size := binary.Varint(d.b)
+		if size <= 0 {
+			d.fail()
+			break
+		}
+		c.Int = n
+		d.b = d.b[size:]
+	case ConstUint8:
+		c.Int = int64(d.byte())
+	case ConstArray:
+		n := d.int()
+		if n > len(d.b) {
+			d.fail()
+			break
+		}
+		c.Elems = make([]Constant, 0, n)
+		for ; n > 0 && d.err == nil; n-- {
+			c.Elems = append(c.Elems, d.constant())
+		}
+	case ConstFloat64:
+		if len(d.b) < 8 {
+			d.fail()
+			break
+		}
+		c.Float = math.Float64frombits(binary.LittleEndian.Uint64(d.b))
+		d.b = d.b[8:]
+	default:
+		d.fail()
+	}
+	return c
+}
@@ -0,0 +1,59 @@
+package bytecode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestImageRoundTrip(t *testing.T) {
+	img := &Image{
+		Version:      Version,
+		Start:        3,
+		DataElements: 2,
+		Code:         []byte{OpHalt, OpPushOne, OpPrint, OpHalt},
+		Data: []DataInit{
+			{1, Constant{Kind: ConstArray, Elems: []Constant{{Kind: ConstUint8, Int: 'h'}, {Kind: ConstInt64, Int: -7}, {Kind: ConstFloat64, Float: -0.125}}}},
+		},
+		Constants: []Constant{{Kind: ConstInt64, Int: 1 << 40}, {Kind: ConstFloat64, Float: 6.02e23}},
+		Symbols:   []Symbol{{SymbolLabel, 3, "main"}, {SymbolVar, 0, "count"}},
+		Debug:     &DebugInfo{File: "x.asm", Files: []string{"lib.asm"}, Lines: []LineInfo{{0, 1, 1, 0}, {1, 3, 5, 1}}},
+	}
+	var buf bytes.Buffer
+	if err := WriteImage(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, img) {
+		t.Errorf("expecting: %#v\nreceived: %#v", img, got)
+	}
+	if _, err := ParseImage(buf.Bytes()[:buf.Len()-1]); !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("expecting truncated image to be rejected, got %v", err)
+	}
+}
+
+func TestLegacyImage(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := WriteHeader(&buf, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write([]byte{OpNOP, OpHalt})
+	img, err := ParseImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Version != 0 || img.Start != 1 || img.DataElements != 4 || !bytes.Equal(img.Code, []byte{OpNOP, OpHalt}) {
+		t.Errorf("unexpected legacy image: %#v", img)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	b := append(append([]byte{}, Magic...), Version+1, 0, 0)
+	if _, err := ParseImage(b); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expecting ErrUnsupportedVersion, got %v", err)
+	}
+}
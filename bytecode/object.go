@@ -0,0 +1,174 @@
+package bytecode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// An object starts with ObjectMagic and a uvarint format version, followed
+// by the source file names, vars, labels and instructions, each a uvarint
+// count followed by the entries.
+var ObjectMagic = []byte("\x7fLIO")
+
+// ObjectVersion is the object format version written by WriteObject.
+const ObjectVersion = 1
+
+var ErrInvalidObject = errors.New("invalid object")
+
+// Object is the relocatable output of assembling one source file. Its
+// instructions are not yet encoded: arguments naming labels and vars are kept
+// as names, so that a linker can lay out the code of several objects together
+// and resolve names one object exports for another.
+type Object struct {
+	Files        []string // source files, Files[0] being the one assembled
+	Vars         []ObjectVar
+	Labels       []ObjectLabel
+	Instructions []ObjectInstruction
+}
+
+// ObjectVar is a data slot defined by an object, in slot order.
+type ObjectVar struct {
+	Name   string
+	Export bool
+	Init   *Constant // nil if uninitialised
+}
+
+// ObjectLabel names the instruction at Index, or the end of the code if
+// Index is the number of instructions.
+type ObjectLabel struct {
+	Name   string
+	Index  int
+	Export bool
+}
+
+// ObjectInstruction is an instruction whose argument is either Arg, as for
+// Encode, or the labels or vars named by Refs: one for a branch, load or
+// store, two for mov. Refs may name symbols defined by other objects.
+type ObjectInstruction struct {
+	Op        byte
+	Arg       interface{}
+	Refs      []string
+	Line, Col int
+	File      int // index into Object.Files
+}
+
+// ReadObject reads an object.
+func ReadObject(r io.Reader) (*Object, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseObject(b)
+}
+
+// ParseObject decodes an object.
+func ParseObject(b []byte) (*Object, error) {
+	if !bytes.HasPrefix(b, ObjectMagic) {
+		return nil, ErrInvalidObject
+	}
+	d := decoder{b: b[len(ObjectMagic):]}
+	if v := d.int(); d.err == nil && v != ObjectVersion {
+		return nil, fmt.Errorf("%w: object version %d (supported %d)", ErrUnsupportedVersion, v, ObjectVersion)
+	}
+	obj := &Object{}
+	for n := d.int(); n > 0 && d.err == nil; n-- {
+		obj.Files = append(obj.Files, d.string())
+	}
+	for n := d.int(); n > 0 && d.err == nil; n-- {
+		v := ObjectVar{Name: d.string(), Export: d.byte() != 0}
+		if d.byte() != 0 {
+			c := d.constant()
+			v.Init = &c
+		}
+		obj.Vars = append(obj.Vars, v)
+	}
+	for n := d.int(); n > 0 && d.err == nil; n-- {
+		obj.Labels = append(obj.Labels, ObjectLabel{Name: d.string(), Index: d.int(), Export: d.byte() != 0})
+	}
+	for n := d.int(); n > 0 && d.err == nil; n-- {
+		ins := ObjectInstruction{Op: d.byte()}
+		for refs := d.int(); refs > 0 && d.err == nil; refs-- {
+			ins.Refs = append(ins.Refs, d.string())
+		}
+		if len(ins.Refs) == 0 {
+			arg, size, err := decodeArg(ins.Op, d.b)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidObject, err)
+			}
+			ins.Arg = arg
+			d.b = d.b[size:]
+		}
+		ins.Line, ins.Col, ins.File = d.int(), d.int(), d.int()
+		obj.Instructions = append(obj.Instructions, ins)
+	}
+	if d.err != nil {
+		return nil, ErrInvalidObject
+	}
+	return obj, nil
+}
+
+// decodeArg decodes the argument of op from the start of b.
+func decodeArg(op byte, b []byte) (interface{}, int, error) {
+	_, arg, size, err := Decode(append([]byte{op}, b...))
+	if err != nil {
+		return nil, 0, err
+	}
+	return arg, size - 1, nil
+}
+
+// WriteObject writes obj.
+func WriteObject(w io.Writer, obj *Object) error {
+	var e encoder
+	e.buf.Write(ObjectMagic)
+	e.int(ObjectVersion)
+	e.int(len(obj.Files))
+	for _, f := range obj.Files {
+		e.string(f)
+	}
+	e.int(len(obj.Vars))
+	for _, v := range obj.Vars {
+		e.string(v.Name)
+		e.bool(v.Export)
+		e.bool(v.Init != nil)
+		if v.Init != nil {
+			e.constant(*v.Init)
+		}
+	}
+	e.int(len(obj.Labels))
+	for _, l := range obj.Labels {
+		e.string(l.Name)
+		e.int(l.Index)
+		e.bool(l.Export)
+	}
+	e.int(len(obj.Instructions))
+	for _, ins := range obj.Instructions {
+		e.buf.WriteByte(ins.Op)
+		e.int(len(ins.Refs))
+		for _, ref := range ins.Refs {
+			e.string(ref)
+		}
+		if len(ins.Refs) == 0 {
+			var arg bytes.Buffer
+			if _, err := Encode(&arg, ins.Op, ins.Arg); err != nil {
+				return err
+			}
+			e.buf.Write(arg.Bytes()[1:])
+		}
+		e.int(ins.Line)
+		e.int(ins.Col)
+		e.int(ins.File)
+	}
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
@@ -0,0 +1,43 @@
+package bytecode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestObjectRoundTrip(t *testing.T) {
+	obj := &Object{
+		Files: []string{"a.asm", "lib.asm"},
+		Vars: []ObjectVar{
+			{Name: "count", Export: true, Init: &Constant{Kind: ConstInt64, Int: 3}},
+			{Name: "scratch"},
+		},
+		Labels: []ObjectLabel{{Name: "main", Index: 0}, {Name: "done", Index: 4, Export: true}},
+		Instructions: []ObjectInstruction{
+			{Op: OpPushInt64, Arg: int64(-300), Line: 2, Col: 2},
+			{Op: OpPushUint8, Arg: byte('a'), Line: 3, Col: 2, File: 1},
+			{Op: OpCall, Refs: []string{"greet"}, Line: 4, Col: 2},
+			{Op: OpMov, Refs: []string{"count", "scratch"}, Line: 5, Col: 2},
+			{Op: OpHalt, Line: 6, Col: 2},
+		},
+	}
+	var buf bytes.Buffer
+	if err := WriteObject(&buf, obj); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseObject(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("expecting: %#v\nreceived: %#v", obj, got)
+	}
+	if _, err := ParseObject(buf.Bytes()[:buf.Len()-1]); !errors.Is(err, ErrInvalidObject) {
+		t.Errorf("expecting truncated object to be rejected, got %v", err)
+	}
+	if _, err := ParseObject([]byte("\x7fLIL")); !errors.Is(err, ErrInvalidObject) {
+		t.Errorf("expecting image to be rejected as an object, got %v", err)
+	}
+}
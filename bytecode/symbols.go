@@ -0,0 +1,149 @@
+package bytecode
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SymbolTable resolves code offsets and data slots to the names and source
+// positions recorded in an image. A nil *SymbolTable resolves nothing.
+type SymbolTable struct {
+	labels map[int][]string
+	vars   map[int]string
+	debug  DebugInfo // Lines sorted by offset
+}
+
+// NewSymbolTable indexes the symbols and debug info of img, returning nil if
+// it has neither.
+func NewSymbolTable(img *Image) *SymbolTable {
+	if len(img.Symbols) == 0 && img.Debug == nil {
+		return nil
+	}
+	t := &SymbolTable{labels: make(map[int][]string), vars: make(map[int]string)}
+	for _, sym := range img.Symbols {
+		switch sym.Kind {
+		case SymbolLabel:
+			t.labels[sym.Value] = append(t.labels[sym.Value], sym.Name)
+		case SymbolVar:
+			t.vars[sym.Value] = sym.Name
+		}
+	}
+	if img.Debug != nil {
+		t.debug = DebugInfo{File: img.Debug.File, Files: img.Debug.Files}
+		t.debug.Lines = append(t.debug.Lines, img.Debug.Lines...)
+		lines := t.debug.Lines
+		sort.Slice(lines, func(i, j int) bool { return lines[i].Offset < lines[j].Offset })
+	}
+	return t
+}
+
+// Labels returns the names of the labels at off.
+func (t *SymbolTable) Labels(off int) []string {
+	if t == nil {
+		return nil
+	}
+	return t.labels[off]
+}
+
+// Label returns the first name of a label at off.
+func (t *SymbolTable) Label(off int) (string, bool) {
+	if names := t.Labels(off); len(names) > 0 {
+		return names[0], true
+	}
+	return "", false
+}
+
+// Var returns the name of the var stored in slot.
+func (t *SymbolTable) Var(slot int) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	name, ok := t.vars[slot]
+	return name, ok
+}
+
+// Line returns the source position of the instruction at off.
+func (t *SymbolTable) Line(off int) (LineInfo, bool) {
+	if t == nil {
+		return LineInfo{}, false
+	}
+	lines := t.debug.Lines
+	i := sort.Search(len(lines), func(i int) bool { return lines[i].Offset >= off })
+	if i == len(lines) || lines[i].Offset != off {
+		return LineInfo{}, false
+	}
+	return lines[i], true
+}
+
+// File returns the name of the file that was assembled, as recorded in the
+// debug info.
+func (t *SymbolTable) File() string {
+	if t == nil {
+		return ""
+	}
+	return t.debug.File
+}
+
+// SourceFile returns the name of the source file of the instruction at off,
+// which may be a file included by File.
+func (t *SymbolTable) SourceFile(off int) string {
+	l, ok := t.Line(off)
+	if !ok {
+		return ""
+	}
+	return t.debug.FileName(l)
+}
+
+// Position formats the source position of the instruction at off as
+// file:line, or returns the empty string if it is unknown.
+func (t *SymbolTable) Position(off int) string {
+	l, ok := t.Line(off)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", t.debug.FileName(l), l.Line)
+}
+
+// Instruction formats an instruction as assembly, naming branch targets and
+// data slots where symbols are known.
+func (t *SymbolTable) Instruction(op byte, arg interface{}) string {
+	target := func(off int) string {
+		if name, ok := t.Label(off); ok {
+			return name
+		}
+		return fmt.Sprintf("%04d", off)
+	}
+	slot := func(n int) string {
+		if name, ok := t.Var(n); ok {
+			return name
+		}
+		return fmt.Sprintf("d%d", n)
+	}
+	return FormatInstruction(op, arg, target, slot)
+}
+
+// FormatInstruction formats an instruction as assembly, using target to
+// format branch targets and slot to format data slots.
+func FormatInstruction(op byte, arg interface{}, target, slot func(int) string) string {
+	ins, ok := Lookup(op)
+	if !ok {
+		return fmt.Sprintf("op(%d)", op)
+	}
+	switch {
+	case IsBranch(op):
+		return ins.Name + " " + target(int(arg.(int64)))
+	case op == OpLoad || op == OpStore:
+		return ins.Name + " " + slot(int(arg.(int64)))
+	case op == OpMov:
+		pair := arg.([2]int64)
+		return ins.Name + " " + slot(int(pair[0])) + " " + slot(int(pair[1]))
+	case ins.Arg == ArgFloat:
+		return ins.Name + " " + FormatFloat(arg.(float64))
+	case ins.Arg == ArgIntPair:
+		pair := arg.([2]int64)
+		return fmt.Sprintf("%s %d %d", ins.Name, pair[0], pair[1])
+	case arg != nil:
+		return fmt.Sprintf("%s %d", ins.Name, arg)
+	}
+	return ins.Name
+}
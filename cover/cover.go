@@ -0,0 +1,202 @@
+package cover
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+
+	"github.com/bruston/lil/bytecode"
+	"github.com/bruston/lil/vm"
+)
+
+var ErrNoDebugInfo = errors.New("image has no source line information, assemble it with -g")
+
+// Line is the coverage of one line of assembly source.
+type Line struct {
+	Number   int
+	Text     string
+	Code     bool  // the line assembled to at least one instruction
+	Hits     int64 // executions of the line's most executed instruction
+	Missed   int   // instructions on the line that never executed
+	Branches []vm.BranchCount
+}
+
+// Report maps the coverage recorded while running an image back to the
+// source it was assembled from.
+type Report struct {
+	File                string
+	Lines               []Line
+	Instructions        int
+	InstructionsCovered int
+	Branches            int // branch directions, two per conditional branch
+	BranchesCovered     int
+}
+
+// New builds a report from the coverage c recorded while running img, which
+// must carry the debug info of an assembly of src. Instructions assembled
+// from included files count towards the totals but annotate no line.
+func New(src []byte, img *bytecode.Image, c *vm.Coverage) (*Report, error) {
+	if img.Debug == nil {
+		return nil, ErrNoDebugInfo
+	}
+	r := &Report{File: img.Debug.File}
+	sc := bufio.NewScanner(bytes.NewReader(src))
+	for n := 1; sc.Scan(); n++ {
+		r.Lines = append(r.Lines, Line{Number: n, Text: sc.Text()})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	syms := bytecode.NewSymbolTable(img)
+	for pos := 0; pos < len(img.Code); {
+		op, _, size, err := bytecode.Decode(img.Code[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("decoding instruction at %04d: %w", pos, err)
+		}
+		hits := c.Hits[pos]
+		r.Instructions++
+		if hits > 0 {
+			r.InstructionsCovered++
+		}
+		var b vm.BranchCount
+		if bytecode.IsConditional(op) {
+			if bc, ok := c.Branches[pos]; ok {
+				b = *bc
+			}
+			r.Branches += 2
+			if b.Taken > 0 {
+				r.BranchesCovered++
+			}
+			if b.NotTaken > 0 {
+				r.BranchesCovered++
+			}
+		}
+		if li, ok := syms.Line(pos); ok && li.File == 0 && li.Line > 0 && li.Line <= len(r.Lines) {
+			l := &r.Lines[li.Line-1]
+			l.Code = true
+			if hits > l.Hits {
+				l.Hits = hits
+			}
+			if hits == 0 {
+				l.Missed++
+			}
+			if bytecode.IsConditional(op) {
+				l.Branches = append(l.Branches, b)
+			}
+		}
+		pos += size
+	}
+	return r, nil
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// Percent returns the percentage of instructions that executed.
+func (r *Report) Percent() float64 { return percent(r.InstructionsCovered, r.Instructions) }
+
+// BranchPercent returns the percentage of branch directions that were taken.
+func (r *Report) BranchPercent() float64 { return percent(r.BranchesCovered, r.Branches) }
+
+// Summary describes the report's totals in a single line.
+func (r *Report) Summary() string {
+	return fmt.Sprintf("%s: %.1f%% of instructions (%d/%d), %.1f%% of branches (%d/%d)",
+		r.File, r.Percent(), r.InstructionsCovered, r.Instructions, r.BranchPercent(), r.BranchesCovered, r.Branches)
+}
+
+// count formats the execution count column of an annotated listing: - for
+// lines without code and ##### for lines with code that never executed.
+func (l Line) count() string {
+	switch {
+	case !l.Code:
+		return "-"
+	case l.Hits == 0:
+		return "#####"
+	case l.Missed > 0:
+		return strconv.FormatInt(l.Hits, 10) + "*"
+	}
+	return strconv.FormatInt(l.Hits, 10)
+}
+
+// class names the highlighting of a line in the HTML report.
+func (l Line) class() string {
+	switch {
+	case !l.Code:
+		return "none"
+	case l.Hits == 0:
+		return "missed"
+	case l.Missed > 0:
+		return "partial"
+	}
+	for _, b := range l.Branches {
+		if b.Taken == 0 || b.NotTaken == 0 {
+			return "partial"
+		}
+	}
+	return "covered"
+}
+
+// WriteText writes an annotated listing of the source to w, each line
+// prefixed with its execution count and followed by the outcome of any
+// conditional branches on it. A * after a count marks a line on which some
+// instructions never executed.
+func (r *Report) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range r.Lines {
+		fmt.Fprintf(bw, "%9s:%5d:%s\n", l.count(), l.Number, l.Text)
+		for _, b := range l.Branches {
+			fmt.Fprintf(bw, "%9s  branch taken %d, not taken %d\n", "", b.Taken, b.NotTaken)
+		}
+	}
+	fmt.Fprintln(bw, r.Summary())
+	return bw.Flush()
+}
+
+var htmlTemplate = template.Must(template.New("cover").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.File}} coverage</title>
+<style>
+body { font-family: monospace; }
+table { border-collapse: collapse; }
+td { padding: 0 0.5em; white-space: pre; }
+td.count, td.number { text-align: right; color: #666; }
+tr.covered td.source { background: #dfd; }
+tr.partial td.source { background: #ffd; }
+tr.missed td.source { background: #fdd; }
+</style>
+</head>
+<body>
+<p>{{.Summary}}</p>
+<table>
+{{range .Lines}}<tr class="{{.Class}}"><td class="count">{{.Count}}</td><td class="number">{{.Number}}</td><td class="source">{{.Text}}{{range .Branches}}  ; taken {{.Taken}}, not taken {{.NotTaken}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes the annotated listing to w as an HTML page, highlighting
+// covered, partially covered and missed lines.
+func (r *Report) WriteHTML(w io.Writer) error {
+	type htmlLine struct {
+		Line
+		Count, Class string
+	}
+	lines := make([]htmlLine, len(r.Lines))
+	for i, l := range r.Lines {
+		lines[i] = htmlLine{l, l.count(), l.class()}
+	}
+	return htmlTemplate.Execute(w, struct {
+		File, Summary string
+		Lines         []htmlLine
+	}{r.File, r.Summary(), lines})
+}
@@ -0,0 +1,63 @@
+package cover
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bruston/lil/asm"
+	"github.com/bruston/lil/vm"
+)
+
+const src = `:main
+	push_zero
+	jump_true skip
+	push_one
+	drop
+	halt
+:skip
+	halt
+`
+
+func TestReport(t *testing.T) {
+	img, err := asm.Assemble(strings.NewReader(src), asm.Options{File: "test.asm", Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := vm.Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Coverage = vm.NewCoverage()
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New([]byte(src), img, m.Coverage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Instructions != 6 || r.InstructionsCovered != 5 || r.Branches != 2 || r.BranchesCovered != 1 {
+		t.Errorf("unexpected totals: %+v", r)
+	}
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"        -:    1::main\n",
+		"        1:    3:\tjump_true skip\n           branch taken 0, not taken 1\n",
+		"    #####:    8:\thalt\n",
+		"test.asm: 83.3% of instructions (5/6), 50.0% of branches (1/2)\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expecting listing to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+	buf.Reset()
+	if err := r.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<tr class="missed"><td class="count">#####</td><td class="number">8</td>`) {
+		t.Errorf("expecting the unexecuted halt to be marked as missed, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,307 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bruston/lil/bytecode"
+	"github.com/bruston/lil/vm"
+)
+
+// Debugger drives a vm.Machine from commands read one per line.
+type Debugger struct {
+	m       *vm.Machine
+	out     io.Writer
+	labels  map[string]int // label name to code offset
+	names   map[int]string // code offset to label name
+	vars    map[string]int // var name to data slot
+	slots   map[int]string // data slot to var name
+	breaks  map[int]bool
+	watches map[int]bool
+}
+
+// New returns a debugger for m, using symbols to resolve label and var names.
+func New(m *vm.Machine, symbols []bytecode.Symbol) *Debugger {
+	d := &Debugger{
+		m:       m,
+		labels:  make(map[string]int),
+		names:   make(map[int]string),
+		vars:    make(map[string]int),
+		slots:   make(map[int]string),
+		breaks:  make(map[int]bool),
+		watches: make(map[int]bool),
+	}
+	for _, sym := range symbols {
+		switch sym.Kind {
+		case bytecode.SymbolLabel:
+			d.labels[sym.Name] = sym.Value
+			d.names[sym.Value] = sym.Name
+		case bytecode.SymbolVar:
+			d.vars[sym.Name] = sym.Value
+			d.slots[sym.Value] = sym.Name
+		}
+	}
+	return d
+}
+
+const help = `commands:
+  break <offset|label>    stop before executing the instruction (b)
+  delete <offset|label>   remove a breakpoint
+  watch <var>             stop after an instruction writes to var (w)
+  unwatch <var>           remove a watchpoint
+  step                    execute one instruction (s)
+  next                    execute one instruction, stepping over calls (n)
+  finish                  run until the current call returns
+  continue                run until a breakpoint, watchpoint or halt (c)
+  where                   show the next instruction
+  stack                   print the operand stack, top first
+  calls                   print the call stack, innermost first (bt)
+  data [var]              print data slots, or a single var (p)
+  help                    show this message
+  quit                    stop debugging (q)
+`
+
+// Run reads commands from in until it is exhausted or a quit command is read.
+// The program reads its own input from the machine's Stdin, which should not
+// be in.
+func (d *Debugger) Run(in io.Reader, out io.Writer) error {
+	d.out = out
+	d.where()
+	sc := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "(lil) ")
+		if !sc.Scan() {
+			fmt.Fprintln(out)
+			return sc.Err()
+		}
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "q" {
+			return nil
+		}
+		if err := d.command(fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+func (d *Debugger) command(cmd string, args []string) error {
+	switch cmd {
+	case "break", "b", "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <offset|label>", cmd)
+		}
+		off, err := d.offset(args[0])
+		if err != nil {
+			return err
+		}
+		if cmd == "delete" {
+			delete(d.breaks, off)
+			return nil
+		}
+		d.breaks[off] = true
+		fmt.Fprintf(d.out, "breakpoint at %s\n", d.location(off))
+	case "watch", "w", "unwatch":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <var>", cmd)
+		}
+		slot, err := d.slot(args[0])
+		if err != nil {
+			return err
+		}
+		if cmd == "unwatch" {
+			delete(d.watches, slot)
+			return nil
+		}
+		d.watches[slot] = true
+	case "step", "s":
+		return d.resume(func() bool { return true })
+	case "next", "n":
+		op, _, size, err := bytecode.Decode(d.m.Instructions[d.m.IP:])
+		if err != nil {
+			return err
+		}
+		if op != bytecode.OpCall {
+			return d.resume(func() bool { return true })
+		}
+		ret, depth := d.m.IP+size, d.m.CallStack.Len()
+		return d.resume(func() bool { return d.m.IP == ret && d.m.CallStack.Len() == depth })
+	case "finish":
+		depth := d.m.CallStack.Len()
+		if depth == 0 {
+			return fmt.Errorf("not inside a call")
+		}
+		return d.resume(func() bool { return d.m.CallStack.Len() < depth })
+	case "continue", "c":
+		return d.resume(func() bool { return false })
+	case "where":
+		d.where()
+	case "stack":
+		values := d.m.Stack.Values()
+		for i := len(values) - 1; i >= 0; i-- {
+			fmt.Fprintf(d.out, "  %d: %v\n", len(values)-1-i, values[i])
+		}
+	case "calls", "bt":
+		values := d.m.CallStack.Values()
+		for i := len(values) - 1; i >= 0; i-- {
+			if f, ok := values[i].(*vm.Frame); ok {
+				fmt.Fprintf(d.out, "  return to %s\n", d.location(f.Return))
+			}
+		}
+	case "data", "p":
+		if len(args) == 1 {
+			slot, err := d.slot(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(d.out, "  %s = %v\n", d.slotName(slot), d.m.Data[slot])
+			return nil
+		}
+		for slot, v := range d.m.Data {
+			fmt.Fprintf(d.out, "  %s = %v\n", d.slotName(slot), v)
+		}
+	case "help", "h":
+		fmt.Fprint(d.out, help)
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	}
+	return nil
+}
+
+// resume steps the machine until done reports true, a breakpoint is reached,
+// a watched var is written or the machine stops.
+func (d *Debugger) resume(done func() bool) error {
+	switch d.m.State() {
+	case vm.Halted:
+		return fmt.Errorf("program has halted")
+	case vm.Failed:
+		return fmt.Errorf("program has failed")
+	}
+	for {
+		watched := d.writes()
+		var old vm.Value
+		if watched >= 0 {
+			old = d.m.Data[watched]
+		}
+		if err := d.m.Step(); err != nil {
+			if rerr, ok := err.(*vm.RuntimeError); ok {
+				fmt.Fprint(d.out, rerr.Trace())
+				return nil
+			}
+			return err
+		}
+		if d.m.State() == vm.Halted {
+			fmt.Fprintln(d.out, "program halted")
+			return nil
+		}
+		if watched >= 0 {
+			fmt.Fprintf(d.out, "watchpoint %s: %v -> %v\n", d.slotName(watched), old, d.m.Data[watched])
+			d.where()
+			return nil
+		}
+		if d.breaks[d.m.IP] {
+			fmt.Fprintln(d.out, "breakpoint reached")
+			d.where()
+			return nil
+		}
+		if done() {
+			d.where()
+			return nil
+		}
+	}
+}
+
+// writes returns the watched data slot written by the next instruction, or -1.
+func (d *Debugger) writes() int {
+	op, arg, _, err := bytecode.Decode(d.m.Instructions[d.m.IP:])
+	if err != nil {
+		return -1
+	}
+	var slot int
+	switch op {
+	case bytecode.OpStore:
+		slot = int(arg.(int64))
+	case bytecode.OpMov:
+		slot = int(arg.([2]int64)[1])
+	default:
+		return -1
+	}
+	if !d.watches[slot] {
+		return -1
+	}
+	return slot
+}
+
+func (d *Debugger) where() {
+	if pos := d.m.Symbols.Position(d.m.IP); pos != "" {
+		fmt.Fprintf(d.out, "%s\t%s\t%s\n", d.location(d.m.IP), d.instruction(d.m.IP), pos)
+		return
+	}
+	fmt.Fprintf(d.out, "%s\t%s\n", d.location(d.m.IP), d.instruction(d.m.IP))
+}
+
+func (d *Debugger) instruction(off int) string {
+	if off >= len(d.m.Instructions) {
+		return "<end of code>"
+	}
+	op, arg, _, err := bytecode.Decode(d.m.Instructions[off:])
+	if err != nil {
+		return err.Error()
+	}
+	return bytecode.FormatInstruction(op, arg, d.location, d.slotName)
+}
+
+// location formats a code offset, naming the nearest preceding label.
+func (d *Debugger) location(off int) string {
+	if name, ok := d.names[off]; ok {
+		return fmt.Sprintf("%04d <%s>", off, name)
+	}
+	var offsets []int
+	for o := range d.names {
+		if o < off {
+			offsets = append(offsets, o)
+		}
+	}
+	if len(offsets) == 0 {
+		return fmt.Sprintf("%04d", off)
+	}
+	sort.Ints(offsets)
+	base := offsets[len(offsets)-1]
+	return fmt.Sprintf("%04d <%s+%d>", off, d.names[base], off-base)
+}
+
+func (d *Debugger) slotName(slot int) string {
+	if name, ok := d.slots[slot]; ok {
+		return name
+	}
+	return fmt.Sprintf("d%d", slot)
+}
+
+func (d *Debugger) offset(s string) (int, error) {
+	if off, ok := d.labels[s]; ok {
+		return off, nil
+	}
+	off, err := strconv.Atoi(s)
+	if err != nil || off < 0 || off >= len(d.m.Instructions) {
+		return 0, fmt.Errorf("no such label or offset: %s", s)
+	}
+	return off, nil
+}
+
+func (d *Debugger) slot(s string) (int, error) {
+	if slot, ok := d.vars[s]; ok {
+		return slot, nil
+	}
+	if strings.HasPrefix(s, "d") {
+		if slot, err := strconv.Atoi(s[1:]); err == nil && slot >= 0 && slot < len(d.m.Data) {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no such var: %s", s)
+}
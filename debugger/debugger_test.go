@@ -0,0 +1,72 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bruston/lil/asm"
+	"github.com/bruston/lil/vm"
+)
+
+const src = `
+var total
+:double
+	dup
+	add
+	ret
+:main
+	push_int64 3
+	call double
+	store total
+	push_one
+	drop
+	halt
+`
+
+func session(t *testing.T, commands string) string {
+	img, err := asm.Assemble(strings.NewReader(src), asm.Options{File: "test.asm", Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := vm.Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := New(m, img.Symbols).Run(strings.NewReader(commands), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestDebugger(t *testing.T) {
+	for i, tt := range []struct {
+		commands string
+		expected []string
+	}{
+		{
+			"next\nnext\nstack\n",
+			[]string{"0003 <main>\tpush_int64 3", "0005 <main+2>\tcall 0000 <double>", "0007 <main+4>\tstore total", "  0: 6"},
+		},
+		{
+			"break double\ncontinue\ncalls\nfinish\n",
+			[]string{"breakpoint at 0000 <double>", "breakpoint reached", "  return to 0007 <main+4>", "0007 <main+4>\tstore total"},
+		},
+		{
+			"watch total\nc\np total\nc\nc\n",
+			[]string{"watchpoint total: <nil> -> 6", "  total = 6", "program halted", "error: program has halted"},
+		},
+		{
+			"break nowhere\nfinish\nfrobnicate\n",
+			[]string{"error: no such label or offset: nowhere", "error: not inside a call", `error: unknown command "frobnicate"`},
+		},
+	} {
+		out := session(t, tt.commands)
+		for _, want := range tt.expected {
+			if !strings.Contains(out, want) {
+				t.Errorf("%d. expecting output to contain %q, got:\n%s", i, want, out)
+			}
+		}
+	}
+}
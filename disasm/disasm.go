@@ -0,0 +1,206 @@
+package disasm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+type instruction struct {
+	offset int
+	op     byte
+	arg    interface{}
+}
+
+// Disassemble writes an assembly listing of image to w. Every instruction is
+// annotated with its byte offset, and its source position if the image has
+// debug info. Labels and vars take their names from the image's symbols,
+// falling back to synthetic L0012 style labels for branch targets and d0, d1,
+// ... for data slots, so that the listing assembles back to the same code.
+func Disassemble(w io.Writer, image []byte) error {
+	img, err := bytecode.ParseImage(image)
+	if err != nil {
+		return err
+	}
+	start, dataElements, code := img.Start, img.DataElements, img.Code
+	syms := bytecode.NewSymbolTable(img)
+	var program []instruction
+	boundaries := make(map[int]bool)
+	for pos := 0; pos < len(code); {
+		op, arg, n, err := bytecode.Decode(code[pos:])
+		if err != nil {
+			return fmt.Errorf("offset %d: %v", pos, err)
+		}
+		program = append(program, instruction{pos, op, arg})
+		boundaries[pos] = true
+		pos += n
+	}
+	boundaries[len(code)] = true
+	if !boundaries[start] {
+		return fmt.Errorf("start offset %d is not an instruction boundary", start)
+	}
+	labels := make(map[int][]string)
+	for off := range boundaries {
+		labels[off] = append([]string(nil), syms.Labels(off)...)
+	}
+	if !contains(labels[start], "main") {
+		labels[start] = append(labels[start], "main")
+	}
+	for _, ins := range program {
+		if !bytecode.IsBranch(ins.op) {
+			continue
+		}
+		target := int(ins.arg.(int64))
+		if !boundaries[target] {
+			return fmt.Errorf("offset %d: branch target %d is not an instruction boundary", ins.offset, target)
+		}
+		if len(labels[target]) == 0 {
+			labels[target] = []string{fmt.Sprintf("L%04d", target)}
+		}
+	}
+	inits := make(map[int]bytecode.Constant)
+	for _, d := range img.Data {
+		inits[d.Slot] = d.Value
+	}
+	for i := 0; i < dataElements; i++ {
+		decl := "var " + slotName(syms, i)
+		if c, ok := inits[i]; ok {
+			init, ok := initialiser(c)
+			if !ok {
+				return fmt.Errorf("data slot %d: initial value cannot be expressed in assembly", i)
+			}
+			decl += " " + init
+		}
+		fmt.Fprintln(w, decl)
+	}
+	for _, ins := range program {
+		for _, label := range labels[ins.offset] {
+			fmt.Fprintf(w, ":%s\n", label)
+		}
+		text, err := format(ins, labels, syms, dataElements)
+		if err != nil {
+			return err
+		}
+		comment := fmt.Sprintf("%04d", ins.offset)
+		if pos := syms.Position(ins.offset); pos != "" {
+			comment += " " + pos
+		}
+		if _, err := fmt.Fprintf(w, "\t%-24s ; %s\n", text, comment); err != nil {
+			return err
+		}
+	}
+	for _, label := range labels[len(code)] {
+		fmt.Fprintf(w, ":%s\n", label)
+	}
+	return nil
+}
+
+// initialiser formats c as the initial value of a var declaration, reporting
+// false if the assembler has no syntax for it.
+func initialiser(c bytecode.Constant) (string, bool) {
+	switch c.Kind {
+	case bytecode.ConstInt64, bytecode.ConstFloat64:
+		return number(c)
+	case bytecode.ConstArray:
+		if len(c.Elems) == 0 {
+			return `""`, true
+		}
+		switch c.Elems[0].Kind {
+		case bytecode.ConstUint8:
+			var b strings.Builder
+			b.WriteByte('"')
+			for _, el := range c.Elems {
+				if el.Kind != bytecode.ConstUint8 {
+					return "", false
+				}
+				b.WriteString(escape(byte(el.Int)))
+			}
+			b.WriteByte('"')
+			return b.String(), true
+		case bytecode.ConstInt64, bytecode.ConstFloat64:
+			if len(c.Elems) == 1 {
+				return "", false
+			}
+			nums := make([]string, len(c.Elems))
+			for i, el := range c.Elems {
+				n, ok := number(el)
+				if !ok {
+					return "", false
+				}
+				nums[i] = n
+			}
+			return strings.Join(nums, ", "), true
+		}
+	}
+	return "", false
+}
+
+// number formats an int64 or finite float64 constant as a literal.
+func number(c bytecode.Constant) (string, bool) {
+	switch {
+	case c.Kind == bytecode.ConstInt64:
+		return strconv.FormatInt(c.Int, 10), true
+	case c.Kind == bytecode.ConstFloat64 && !math.IsInf(c.Float, 0) && !math.IsNaN(c.Float):
+		return bytecode.FormatFloat(c.Float), true
+	}
+	return "", false
+}
+
+// escape formats b for use inside an assembler string literal.
+func escape(b byte) string {
+	switch b {
+	case '\n':
+		return `\n`
+	case '\t':
+		return `\t`
+	case '\r':
+		return `\r`
+	case 0:
+		return `\0`
+	case '\\', '"':
+		return `\` + string(b)
+	}
+	if b < ' ' || b > '~' {
+		return fmt.Sprintf(`\x%02x`, b)
+	}
+	return string(b)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func slotName(syms *bytecode.SymbolTable, slot int) string {
+	if name, ok := syms.Var(slot); ok {
+		return name
+	}
+	return fmt.Sprintf("d%d", slot)
+}
+
+func format(ins instruction, labels map[int][]string, syms *bytecode.SymbolTable, dataElements int) (string, error) {
+	var slots []int64
+	switch ins.op {
+	case bytecode.OpLoad, bytecode.OpStore:
+		slots = []int64{ins.arg.(int64)}
+	case bytecode.OpMov:
+		pair := ins.arg.([2]int64)
+		slots = pair[:]
+	}
+	for _, n := range slots {
+		if n < 0 || n >= int64(dataElements) {
+			return "", fmt.Errorf("offset %d: data index %d out of range", ins.offset, n)
+		}
+	}
+	target := func(off int) string { return labels[off][0] }
+	slot := func(n int) string { return slotName(syms, n) }
+	return bytecode.FormatInstruction(ins.op, ins.arg, target, slot), nil
+}
@@ -0,0 +1,67 @@
+package disasm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/bruston/lil/asm"
+)
+
+func roundTrip(t *testing.T, src []byte) {
+	var image bytes.Buffer
+	if err := asm.Compile(bytes.NewReader(src), &image); err != nil {
+		t.Fatal(err)
+	}
+	var listing bytes.Buffer
+	if err := Disassemble(&listing, image.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := asm.Compile(bytes.NewReader(listing.Bytes()), &again); err != nil {
+		t.Fatalf("reassembling listing: %v\n%s", err, listing.Bytes())
+	}
+	if !bytes.Equal(image.Bytes(), again.Bytes()) {
+		t.Errorf("round trip mismatch:\n%x\n%x\nlisting:\n%s", image.Bytes(), again.Bytes(), listing.Bytes())
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	loop, err := os.ReadFile("../testdata/loop.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, loop)
+	roundTrip(t, []byte(`
+var a
+var b
+var greeting "hi\t\"there\"\x7f\n"
+var table 1, -2, 3
+var n 42
+var empty ""
+var pi 3.141592653589793
+var mixed 1, 0.1, -2e-9
+:sub
+	mov a b
+	ret
+:main
+	push_uint8 200
+	push_int64 -5
+	push_float64 2
+	push_uint64 18446744073709551615
+	push_uint64 3
+	shl
+	shr
+	to_uint64
+	push_float64 0.1
+	to_float64
+	jump_false end
+	call sub
+	create_array
+	array_load
+	load greeting
+	print_str
+	jump_true sub
+:end
+`))
+}
@@ -0,0 +1,204 @@
+package golden
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bruston/lil/asm"
+	"github.com/bruston/lil/vm"
+)
+
+// DefaultMaxSteps bounds the instructions a program may execute, so that a
+// program that never halts fails rather than hanging the run.
+const DefaultMaxSteps = 10000000
+
+var (
+	ErrMismatch = errors.New("output does not match golden file")
+	ErrNoGolden = errors.New("missing golden file")
+)
+
+// Options controls how programs are run.
+type Options struct {
+	Update   bool  // rewrite golden files with each program's output instead of comparing
+	MaxSteps int64 // DefaultMaxSteps if zero
+}
+
+// Result is the outcome of running one program.
+type Result struct {
+	File    string // path of the .asm file
+	Err     error  // why the program failed, or nil if it passed
+	Diff    string // if Err is ErrMismatch, the expected (-) and actual (+) output lines that differ
+	Updated bool   // the golden file was rewritten
+}
+
+// Run assembles and runs every .asm file in dir. Each program's output is
+// compared with the .out file of the same name; a matching .in file, if
+// present, is supplied as its input.
+func Run(dir string, opts Options) ([]Result, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.asm"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	results := make([]Result, len(files))
+	for i, file := range files {
+		results[i] = RunFile(file, opts)
+	}
+	return results, nil
+}
+
+// Test runs every program in dir as described for Run, reporting each one
+// that fails, or whose golden file is missing or does not match, as an error
+// of t. With opts.Update it rewrites the golden files instead.
+func Test(t testing.TB, dir string, opts Options) {
+	t.Helper()
+	results, err := Run(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatalf("no .asm files in %s", dir)
+	}
+	for _, r := range results {
+		switch {
+		case r.Err == ErrMismatch:
+			t.Errorf("%s: %v\n%s", r.File, r.Err, r.Diff)
+		case r.Err != nil:
+			t.Errorf("%s: %v", r.File, r.Err)
+		case r.Updated:
+			t.Logf("updated golden file for %s", r.File)
+		}
+	}
+}
+
+// RunFile assembles and runs the program in file, comparing its output with
+// the golden file as described for Run.
+func RunFile(file string, opts Options) Result {
+	r := Result{File: file}
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	out, err := run(file, base+".in", opts)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	goldenPath := base + ".out"
+	want, err := ioutil.ReadFile(goldenPath)
+	if err != nil && !os.IsNotExist(err) {
+		r.Err = err
+		return r
+	}
+	if opts.Update {
+		if err != nil || !bytes.Equal(want, out) {
+			r.Err = ioutil.WriteFile(goldenPath, out, 0644)
+			r.Updated = r.Err == nil
+		}
+		return r
+	}
+	if err != nil {
+		r.Err = fmt.Errorf("%w %s", ErrNoGolden, goldenPath)
+		return r
+	}
+	if !bytes.Equal(want, out) {
+		r.Err = ErrMismatch
+		r.Diff = Diff(string(want), string(out))
+	}
+	return r
+}
+
+func run(file, inPath string, opts Options) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := asm.Assemble(f, asm.Options{File: file, Debug: true})
+	if err != nil {
+		return nil, err
+	}
+	m, err := vm.Load(img)
+	if err != nil {
+		return nil, err
+	}
+	in, err := os.Open(inPath)
+	switch {
+	case err == nil:
+		defer in.Close()
+		m.Stdin = in
+	case os.IsNotExist(err):
+		m.Stdin = strings.NewReader("")
+	default:
+		return nil, err
+	}
+	var out bytes.Buffer
+	m.Stdout = &out
+	m.MaxSteps = opts.MaxSteps
+	if m.MaxSteps == 0 {
+		m.MaxSteps = DefaultMaxSteps
+	}
+	if err := m.Exec(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Diff returns the lines that differ between want and got, prefixing lines
+// only in want with - and lines only in got with +. Lines common to both are
+// prefixed with a space.
+func Diff(want, got string) string {
+	a, b := strings.SplitAfter(want, "\n"), strings.SplitAfter(got, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var sb strings.Builder
+	line := func(prefix, s string) {
+		if s == "" {
+			return
+		}
+		sb.WriteString(prefix + s)
+		if !strings.HasSuffix(s, "\n") {
+			sb.WriteString("\n\\ no newline at end\n")
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			line(" ", a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			line("-", a[i])
+			i++
+		default:
+			line("+", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		line("-", a[i])
+	}
+	for ; j < len(b); j++ {
+		line("+", b[j])
+	}
+	return sb.String()
+}
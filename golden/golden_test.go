@@ -0,0 +1,83 @@
+package golden
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the output of each program")
+
+func TestTestdata(t *testing.T) {
+	Test(t, "../testdata", Options{Update: *update})
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"count.asm":   ":main\n\tpush_one\n\tprint\n\tpush_int64 2\n\tprint\n\thalt\n",
+		"count.out":   "13",
+		"missing.asm": ":main\n\thalt\n",
+		"forever.asm": ":main\n:loop\n\tjump loop\n",
+		"forever.out": "",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := Run(dir, Options{MaxSteps: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expecting 3 results, got %d", len(results))
+	}
+	if r := results[0]; r.Err != ErrMismatch || r.Diff != "-13\n\\ no newline at end\n+12\n\\ no newline at end\n" {
+		t.Errorf("expecting mismatch for count.asm, got %v with diff %q", r.Err, r.Diff)
+	}
+	if r := results[1]; r.Err == nil {
+		t.Errorf("expecting forever.asm to exhaust its budget")
+	}
+	if r := results[2]; r.Err == nil {
+		t.Errorf("expecting an error for missing.asm")
+	}
+
+	results, err = Run(dir, Options{Update: true, MaxSteps: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !results[0].Updated || !results[2].Updated {
+		t.Errorf("expecting count.asm and missing.asm to be updated, got %+v", results)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "count.out")); string(b) != "12" {
+		t.Errorf("expecting count.out to be rewritten to %q, got %q", "12", b)
+	}
+	results, err = Run(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("expecting updated programs to pass, got %+v", results)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for i, tt := range []struct {
+		want, got, expected string
+	}{
+		{"a\nb\n", "a\nb\n", " a\n b\n"},
+		{"a\nb\nc\n", "a\nc\n", " a\n-b\n c\n"},
+		{"a\n", "a\nb\n", " a\n+b\n"},
+	} {
+		if d := Diff(tt.want, tt.got); d != tt.expected {
+			t.Errorf("%d. expecting %q, got %q", i, tt.expected, d)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+// maxLayoutPasses bounds the number of times Link lays out the code while
+// waiting for instruction offsets to settle.
+const maxLayoutPasses = 16
+
+var ErrNoMain = errors.New("no object defines main")
+
+// Options control how objects are linked.
+type Options struct {
+	Debug bool // include symbols and a line map in the image
+}
+
+// instruction is an object instruction with its argument resolved to an
+// index into the linked instructions, for branches, or to data slots.
+type instruction struct {
+	bytecode.ObjectInstruction
+	target int // for branches
+	obj    int
+}
+
+type linker struct {
+	objs      []*bytecode.Object
+	varBase   []int // first data slot of each object
+	insBase   []int // index of each object's first instruction
+	labels    []map[string]int
+	vars      []map[string]int
+	expLabels map[string]int // linked instruction index by exported name
+	expVars   map[string]int
+	program   []instruction
+}
+
+// Link combines objs into a single image. Each object's vars are given
+// their own data slots, and names not defined by the object referring to
+// them are resolved against the labels and vars exported by the others. The
+// image starts at the main label, which exactly one object must define.
+func Link(objs []*bytecode.Object, opts Options) (*bytecode.Image, error) {
+	l := &linker{
+		objs:      objs,
+		expLabels: make(map[string]int),
+		expVars:   make(map[string]int),
+	}
+	if err := l.define(); err != nil {
+		return nil, err
+	}
+	start, err := l.main()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.resolve(); err != nil {
+		return nil, err
+	}
+	code, offsets, err := l.layout()
+	if err != nil {
+		return nil, err
+	}
+	img := &bytecode.Image{
+		Version:      bytecode.Version,
+		Start:        offsets[start],
+		DataElements: l.varBase[len(objs)],
+		Code:         code,
+	}
+	for i, obj := range objs {
+		for slot, v := range obj.Vars {
+			if v.Init != nil {
+				img.Data = append(img.Data, bytecode.DataInit{Slot: l.varBase[i] + slot, Value: *v.Init})
+			}
+		}
+	}
+	if opts.Debug {
+		img.Symbols = l.symbols(offsets)
+		img.Debug = l.debug(offsets)
+	}
+	return img, nil
+}
+
+// name identifies object i in errors.
+func (l *linker) name(i int) string {
+	if files := l.objs[i].Files; len(files) > 0 && files[0] != "" {
+		return files[0]
+	}
+	return fmt.Sprintf("object %d", i+1)
+}
+
+// define assigns data slots and instruction indexes to each object's
+// definitions and records the exported ones.
+func (l *linker) define() error {
+	expLabelObj := make(map[string]int)
+	expVarObj := make(map[string]int)
+	slots, index := 0, 0
+	for i, obj := range l.objs {
+		l.varBase = append(l.varBase, slots)
+		l.insBase = append(l.insBase, index)
+		vars := make(map[string]int)
+		for slot, v := range obj.Vars {
+			vars[v.Name] = slots + slot
+			if !v.Export {
+				continue
+			}
+			if j, ok := expVarObj[v.Name]; ok {
+				return fmt.Errorf("var %s exported by both %s and %s", v.Name, l.name(j), l.name(i))
+			}
+			expVarObj[v.Name] = i
+			l.expVars[v.Name] = slots + slot
+		}
+		labels := make(map[string]int)
+		for _, lab := range obj.Labels {
+			if lab.Index < 0 || lab.Index > len(obj.Instructions) {
+				return fmt.Errorf("%s: label %s: %w", l.name(i), lab.Name, bytecode.ErrInvalidObject)
+			}
+			labels[lab.Name] = index + lab.Index
+			if !lab.Export {
+				continue
+			}
+			if j, ok := expLabelObj[lab.Name]; ok {
+				return fmt.Errorf("label %s exported by both %s and %s", lab.Name, l.name(j), l.name(i))
+			}
+			expLabelObj[lab.Name] = i
+			l.expLabels[lab.Name] = index + lab.Index
+		}
+		l.vars = append(l.vars, vars)
+		l.labels = append(l.labels, labels)
+		slots += len(obj.Vars)
+		index += len(obj.Instructions)
+	}
+	l.varBase = append(l.varBase, slots)
+	l.insBase = append(l.insBase, index)
+	return nil
+}
+
+// main returns the index of the instruction labelled main.
+func (l *linker) main() (int, error) {
+	found := -1
+	var start int
+	for i := range l.objs {
+		if n, ok := l.labels[i]["main"]; ok {
+			if found >= 0 {
+				return 0, fmt.Errorf("main defined by both %s and %s", l.name(found), l.name(i))
+			}
+			found, start = i, n
+		}
+	}
+	if found < 0 {
+		return 0, ErrNoMain
+	}
+	return start, nil
+}
+
+// resolve builds the linked program, resolving each reference to a name
+// defined by the same object or, failing that, exported by another.
+func (l *linker) resolve() error {
+	for i, obj := range l.objs {
+		for _, oi := range obj.Instructions {
+			ins := instruction{ObjectInstruction: oi, obj: i}
+			if len(oi.Refs) == 0 {
+				l.program = append(l.program, ins)
+				continue
+			}
+			if bytecode.IsBranch(oi.Op) {
+				n, ok := l.labels[i][oi.Refs[0]]
+				if !ok {
+					if n, ok = l.expLabels[oi.Refs[0]]; !ok {
+						return fmt.Errorf("%s: undefined label %s at line %d pos %d", l.name(i), oi.Refs[0], oi.Line, oi.Col)
+					}
+				}
+				ins.target = n
+				l.program = append(l.program, ins)
+				continue
+			}
+			slots := make([]int64, len(oi.Refs))
+			for j, ref := range oi.Refs {
+				n, ok := l.vars[i][ref]
+				if !ok {
+					if n, ok = l.expVars[ref]; !ok {
+						return fmt.Errorf("%s: undefined var %s at line %d pos %d", l.name(i), ref, oi.Line, oi.Col)
+					}
+				}
+				slots[j] = int64(n)
+			}
+			switch len(slots) {
+			case 1:
+				ins.Arg = slots[0]
+			case 2:
+				ins.Arg = [2]int64{slots[0], slots[1]}
+			default:
+				return fmt.Errorf("%s: %d references in one instruction: %w", l.name(i), len(slots), bytecode.ErrInvalidObject)
+			}
+			ins.Refs = nil
+			l.program = append(l.program, ins)
+		}
+	}
+	return nil
+}
+
+// layout encodes the program, returning the code and the offset of every
+// instruction, plus the offset of the end of the code. Branch arguments are
+// varints, so the code is laid out again until no offset moves.
+func (l *linker) layout() ([]byte, []int, error) {
+	offsets := make([]int, len(l.program)+1)
+	var code bytes.Buffer
+	for pass := 0; pass < maxLayoutPasses; pass++ {
+		code.Reset()
+		moved := false
+		pos := 0
+		for i, ins := range l.program {
+			if offsets[i] != pos {
+				offsets[i] = pos
+				moved = true
+			}
+			arg := ins.Arg
+			if ins.Refs != nil {
+				arg = int64(offsets[ins.target])
+			}
+			n, err := bytecode.Encode(&code, ins.Op, arg)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: line %d: %w", l.name(ins.obj), ins.Line, err)
+			}
+			pos += n
+		}
+		if offsets[len(l.program)] != pos {
+			offsets[len(l.program)] = pos
+			moved = true
+		}
+		if !moved {
+			return code.Bytes(), offsets, nil
+		}
+	}
+	return nil, nil, errors.New("instruction offsets did not settle")
+}
+
+// symbols names the linked labels and vars. Names that are not exported
+// and are defined by more than one object are qualified with the number of
+// the object defining them, as name.2, so that every symbol is unique.
+func (l *linker) symbols(offsets []int) []bytecode.Symbol {
+	labelDefs := make(map[string]int)
+	varDefs := make(map[string]int)
+	for _, obj := range l.objs {
+		for _, lab := range obj.Labels {
+			labelDefs[lab.Name]++
+		}
+		for _, v := range obj.Vars {
+			varDefs[v.Name]++
+		}
+	}
+	qualify := func(name string, export bool, defs map[string]int, obj int) string {
+		if export || defs[name] < 2 {
+			return name
+		}
+		return fmt.Sprintf("%s.%d", name, obj+1)
+	}
+	var labels, vars []bytecode.Symbol
+	for i, obj := range l.objs {
+		for _, lab := range obj.Labels {
+			labels = append(labels, bytecode.Symbol{
+				Kind:  bytecode.SymbolLabel,
+				Value: offsets[l.insBase[i]+lab.Index],
+				Name:  qualify(lab.Name, lab.Export, labelDefs, i),
+			})
+		}
+		for slot, v := range obj.Vars {
+			vars = append(vars, bytecode.Symbol{
+				Kind:  bytecode.SymbolVar,
+				Value: l.varBase[i] + slot,
+				Name:  qualify(v.Name, v.Export, varDefs, i),
+			})
+		}
+	}
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].Value < labels[j].Value })
+	return append(labels, vars...)
+}
+
+// debug maps the linked code back to the source files of the objects. The
+// first object's file becomes the image's main file.
+func (l *linker) debug(offsets []int) *bytecode.DebugInfo {
+	d := &bytecode.DebugInfo{}
+	index := make(map[string]int)
+	fileIndex := func(name string) int {
+		if n, ok := index[name]; ok {
+			return n
+		}
+		n := len(d.Files) + 1
+		if len(index) == 0 {
+			d.File, n = name, 0
+		} else {
+			d.Files = append(d.Files, name)
+		}
+		index[name] = n
+		return n
+	}
+	for i, ins := range l.program {
+		file := ""
+		if files := l.objs[ins.obj].Files; ins.File < len(files) {
+			file = files[ins.File]
+		}
+		d.Lines = append(d.Lines, bytecode.LineInfo{Offset: offsets[i], Line: ins.Line, Col: ins.Col, File: fileIndex(file)})
+	}
+	return d
+}
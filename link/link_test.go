@@ -0,0 +1,101 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bruston/lil/asm"
+	"github.com/bruston/lil/bytecode"
+	"github.com/bruston/lil/vm"
+)
+
+func objects(t *testing.T, srcs ...string) []*bytecode.Object {
+	var objs []*bytecode.Object
+	for i, src := range srcs {
+		obj, err := asm.AssembleObject(strings.NewReader(src), asm.Options{File: string('a'+rune(i)) + ".asm"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+func TestLink(t *testing.T) {
+	objs := objects(t, `
+var count 3
+var tmp
+.export count
+:main
+	call greet
+	load count
+	print
+	halt
+`, `
+var msg "count="
+var tmp
+.export greet
+:greet
+	load msg
+	print_str
+	push_int64 1
+	load count
+	add
+	store count
+	ret
+`)
+	img, err := Link(objs, Options{Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.DataElements != 4 {
+		t.Errorf("expecting 4 data slots, got %d", img.DataElements)
+	}
+	var out bytes.Buffer
+	m, err := vm.Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Stdout = &out
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "count=4" {
+		t.Errorf("expecting output %q, got %q", "count=4", out.String())
+	}
+	names := make(map[string]bool)
+	for _, sym := range img.Symbols {
+		names[sym.Name] = true
+	}
+	for _, name := range []string{"main", "greet", "count", "msg", "tmp.1", "tmp.2"} {
+		if !names[name] {
+			t.Errorf("expecting symbol %s, got %v", name, img.Symbols)
+		}
+	}
+	if img.Debug.File != "a.asm" || len(img.Debug.Files) != 1 || img.Debug.Files[0] != "b.asm" {
+		t.Errorf("expecting files a.asm and b.asm, got %q and %q", img.Debug.File, img.Debug.Files)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	for i, tt := range []struct {
+		srcs     []string
+		expected string
+	}{
+		{[]string{":main\n\tcall f\n\thalt\n", ":f\n\tret\n"}, "a.asm: undefined label f at line 2 pos 2"},
+		{[]string{":main\n\tload x\n\thalt\n", "var x\n"}, "a.asm: undefined var x at line 2 pos 2"},
+		{[]string{":main\n\thalt\n", ":main\n\thalt\n"}, "main defined by both a.asm and b.asm"},
+		{[]string{":f\n\tret\n"}, ErrNoMain.Error()},
+		{[]string{"var x\n.export x\n:main\n\thalt\n", "var x\n.export x\n"}, "var x exported by both a.asm and b.asm"},
+		{[]string{":main\n:f\n.export f\n\thalt\n", ":f\n.export f\n\tret\n"}, "label f exported by both a.asm and b.asm"},
+	} {
+		if _, err := Link(objects(t, tt.srcs...), Options{}); err == nil || err.Error() != tt.expected {
+			t.Errorf("%d. expecting error %q, got %v", i, tt.expected, err)
+		}
+	}
+	if _, err := Link(nil, Options{}); !errors.Is(err, ErrNoMain) {
+		t.Errorf("expecting ErrNoMain, got %v", err)
+	}
+}
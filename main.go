@@ -1,39 +1,119 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/bruston/lil/asm"
+	"github.com/bruston/lil/bytecode"
+	"github.com/bruston/lil/cover"
+	"github.com/bruston/lil/debugger"
+	"github.com/bruston/lil/disasm"
+	"github.com/bruston/lil/golden"
+	"github.com/bruston/lil/link"
+	"github.com/bruston/lil/pprof"
 	"github.com/bruston/lil/vm"
 )
 
+const usage = `Usage is:
+lil run [--max-steps n] [--timeout duration] [--trace] [--trace-format text|json]
+        [--profile out.pprof] file.lil|file.asm
+lil asm [-g] [-c] file.asm [out.lil|out.o]
+lil link [-g] file.o... [-o out.lil]
+lil check file.asm
+lil disasm file.lil
+lil debug [--input file] file.lil|file.asm
+lil cover [--html out.html] [--min percent] file.asm|file.lil
+lil test [--update] [dir]
+`
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stdout, "Usage is:\nlil run file.lil\nlil asm file.asm\n")
+	if len(os.Args) < 2 || len(os.Args) < 3 && os.Args[1] != "test" {
+		fmt.Fprint(os.Stdout, usage)
 		os.Exit(0)
 	}
 	cmd := os.Args[1]
 	switch cmd {
 	case "run":
-		m, err := vm.Open(os.Args[2])
+		fs := flag.NewFlagSet("run", flag.ExitOnError)
+		maxSteps := fs.Int64("max-steps", 0, "stop after executing this many instructions (0 for no limit)")
+		timeout := fs.Duration("timeout", 0, "stop after running for this long (0 for no limit)")
+		trace := fs.Bool("trace", false, "write a record of every executed instruction to stderr")
+		traceFormat := fs.String("trace-format", "text", "trace record format: text or json")
+		profile := fs.String("profile", "", "write a pprof instruction profile to this file")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() < 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		img, err := load(fs.Arg(0))
 		if err != nil {
-			fmt.Println(os.Stderr, "error opening vm image:", err)
+			fmt.Fprintln(os.Stderr, "error opening vm image:", err)
 			os.Exit(1)
 		}
-		if err := m.Exec(); err != nil {
-			fmt.Fprintln(os.Stderr, "error encountered during execution:", err)
+		m, err := vm.Load(img)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error opening vm image:", err)
+			os.Exit(1)
+		}
+		if *profile != "" {
+			m.Profile = vm.NewProfile()
+		}
+		m.MaxSteps = *maxSteps
+		if *trace {
+			switch *traceFormat {
+			case "text":
+				m.Tracer = vm.NewTextTracer(os.Stderr)
+			case "json":
+				m.Tracer = vm.NewJSONTracer(os.Stderr)
+			default:
+				fmt.Fprintln(os.Stderr, "unknown trace format, valid formats are text and json")
+				os.Exit(1)
+			}
+		}
+		if *timeout > 0 {
+			m.Deadline = time.Now().Add(*timeout)
+		}
+		execErr := m.Exec()
+		if *profile != "" {
+			if err := writeProfile(*profile, m.Profile, img); err != nil {
+				fmt.Fprintln(os.Stderr, "error writing profile:", err)
+				os.Exit(1)
+			}
+		}
+		if execErr != nil {
+			var rerr *vm.RuntimeError
+			if errors.As(execErr, &rerr) {
+				fmt.Fprint(os.Stderr, rerr.Trace())
+			} else {
+				fmt.Fprintln(os.Stderr, "error encountered during execution:", execErr)
+			}
 			os.Exit(1)
 		}
 	case "asm":
-		var outPath string
-		if len(os.Args) < 4 {
-			outPath = "out.lil"
-		} else {
-			outPath = os.Args[3]
+		fs := flag.NewFlagSet("asm", flag.ExitOnError)
+		debug := fs.Bool("g", false, "include symbols and a source line map in the image")
+		object := fs.Bool("c", false, "write a relocatable object for lil link instead of an image")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() < 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
 		}
-		f, err := os.Open(os.Args[2])
+		outPath := "out.lil"
+		if *object {
+			outPath = "out.o"
+		}
+		if fs.NArg() > 1 {
+			outPath = fs.Arg(1)
+		}
+		f, err := os.Open(fs.Arg(0))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -43,7 +123,13 @@ func main() {
 			fmt.Fprintln(os.Stderr, "unable to create output file:", err)
 			os.Exit(1)
 		}
-		if err := asm.Compile(f, out); err != nil {
+		opts := asm.Options{File: fs.Arg(0), Debug: *debug}
+		if *object {
+			err = compileObject(f, out, opts)
+		} else {
+			err = asm.CompileOptions(f, out, opts)
+		}
+		if err != nil {
 			fmt.Fprintln(os.Stderr, "error compiling asm:", err)
 			os.Exit(1)
 		}
@@ -51,8 +137,250 @@ func main() {
 			fmt.Fprintln(os.Stderr, "error closing output file, contents may not have been written correctly:", err)
 			os.Exit(1)
 		}
+	case "link":
+		fs := flag.NewFlagSet("link", flag.ExitOnError)
+		debug := fs.Bool("g", false, "include symbols and a source line map in the image")
+		outPath := fs.String("o", "out.lil", "write the image to this file")
+		var paths []string
+		for args := os.Args[2:]; ; {
+			fs.Parse(args)
+			if fs.NArg() == 0 {
+				break
+			}
+			paths = append(paths, fs.Arg(0))
+			args = fs.Args()[1:]
+		}
+		if len(paths) == 0 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		var objs []*bytecode.Object
+		for _, path := range paths {
+			obj, err := readObject(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error reading object %s: %v\n", path, err)
+				os.Exit(1)
+			}
+			objs = append(objs, obj)
+		}
+		img, err := link.Link(objs, link.Options{Debug: *debug})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error linking:", err)
+			os.Exit(1)
+		}
+		out, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "unable to create output file:", err)
+			os.Exit(1)
+		}
+		if err := bytecode.WriteImage(out, img); err != nil {
+			fmt.Fprintln(os.Stderr, "error writing image:", err)
+			os.Exit(1)
+		}
+		if err := out.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "error closing output file, contents may not have been written correctly:", err)
+			os.Exit(1)
+		}
+	case "check":
+		f, err := os.Open(os.Args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error opening source:", err)
+			os.Exit(1)
+		}
+		diags := asm.Check(f, asm.Options{File: os.Args[2]})
+		f.Close()
+		if _, err := diags.WriteTo(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error writing diagnostics:", err)
+			os.Exit(1)
+		}
+		if len(diags.Errors()) > 0 {
+			os.Exit(1)
+		}
+	case "disasm":
+		b, err := ioutil.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error opening vm image:", err)
+			os.Exit(1)
+		}
+		if err := disasm.Disassemble(os.Stdout, b); err != nil {
+			fmt.Fprintln(os.Stderr, "error disassembling image:", err)
+			os.Exit(1)
+		}
+	case "debug":
+		// Debugger commands are read from stdin, so the program reads its
+		// input from the --input file, or sees no input at all.
+		fs := flag.NewFlagSet("debug", flag.ExitOnError)
+		input := fs.String("input", "", "file the program reads its input from (default no input)")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() < 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		img, err := load(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error loading program:", err)
+			os.Exit(1)
+		}
+		m, err := vm.Load(img)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error loading vm image:", err)
+			os.Exit(1)
+		}
+		m.Stdin = strings.NewReader("")
+		if *input != "" {
+			f, err := os.Open(*input)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error opening input:", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			m.Stdin = f
+		}
+		if err := debugger.New(m, img.Symbols).Run(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error reading commands:", err)
+			os.Exit(1)
+		}
+	case "cover":
+		fs := flag.NewFlagSet("cover", flag.ExitOnError)
+		htmlPath := fs.String("html", "", "write an HTML report to this file instead of an annotated listing")
+		min := fs.Float64("min", 0, "fail unless at least this percentage of instructions executed")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() < 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		img, err := load(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error loading program:", err)
+			os.Exit(1)
+		}
+		if img.Debug == nil {
+			fmt.Fprintln(os.Stderr, "error loading program:", cover.ErrNoDebugInfo)
+			os.Exit(1)
+		}
+		src, err := ioutil.ReadFile(img.Debug.File)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading source:", err)
+			os.Exit(1)
+		}
+		m, err := vm.Load(img)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error loading vm image:", err)
+			os.Exit(1)
+		}
+		m.Coverage = vm.NewCoverage()
+		if err := m.Exec(); err != nil {
+			fmt.Fprintln(os.Stderr, "error encountered during execution:", err)
+		}
+		report, err := cover.New(src, img, m.Coverage)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error building coverage report:", err)
+			os.Exit(1)
+		}
+		if *htmlPath != "" {
+			err = writeHTML(*htmlPath, report)
+			fmt.Println(report.Summary())
+		} else {
+			err = report.WriteText(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error writing coverage report:", err)
+			os.Exit(1)
+		}
+		if report.Percent() < *min {
+			fmt.Fprintf(os.Stderr, "coverage %.1f%% is below the minimum of %.1f%%\n", report.Percent(), *min)
+			os.Exit(1)
+		}
+	case "test":
+		fs := flag.NewFlagSet("test", flag.ExitOnError)
+		update := fs.Bool("update", false, "rewrite golden files with the output of each program")
+		fs.Parse(os.Args[2:])
+		dir := "testdata"
+		if fs.NArg() > 0 {
+			dir = fs.Arg(0)
+		}
+		results, err := golden.Run(dir, golden.Options{Update: *update})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error finding programs:", err)
+			os.Exit(1)
+		}
+		if len(results) == 0 {
+			fmt.Fprintln(os.Stderr, "no .asm files in", dir)
+			os.Exit(1)
+		}
+		failed := 0
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				failed++
+				fmt.Printf("FAIL %s: %v\n%s", r.File, r.Err, r.Diff)
+			case r.Updated:
+				fmt.Println("updated", r.File)
+			default:
+				fmt.Println("ok  ", r.File)
+			}
+		}
+		if failed > 0 {
+			fmt.Printf("%d of %d programs failed\n", failed, len(results))
+			os.Exit(1)
+		}
 	default:
-		fmt.Fprintln(os.Stderr, "unknown command, valid commands are asm and run")
+		fmt.Fprintln(os.Stderr, "unknown command, valid commands are asm, check, cover, debug, disasm, link, run and test")
 		os.Exit(1)
 	}
 }
+
+// load reads a program image, assembling it first if path names an .asm file.
+func load(path string) (*bytecode.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.HasSuffix(path, ".asm") {
+		return asm.Assemble(f, asm.Options{File: path, Debug: true})
+	}
+	return bytecode.ReadImage(f)
+}
+
+// compileObject assembles src into a relocatable object and writes it to dst.
+func compileObject(src io.Reader, dst io.Writer, opts asm.Options) error {
+	obj, err := asm.AssembleObject(src, opts)
+	if err != nil {
+		return err
+	}
+	return bytecode.WriteObject(dst, obj)
+}
+
+func readObject(path string) (*bytecode.Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return bytecode.ReadObject(f)
+}
+
+func writeProfile(path string, p *vm.Profile, img *bytecode.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Write(f, p, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeHTML(path string, r *cover.Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.WriteHTML(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,202 @@
+package pprof
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bruston/lil/bytecode"
+	"github.com/bruston/lil/vm"
+)
+
+// Write writes the samples in p to w as a gzip-compressed pprof profile, as
+// read by go tool pprof. Locations are code offsets within img; each is
+// attributed to the function whose entry point, img's start offset or the
+// target of a call instruction, most closely precedes it. Functions and lines
+// are named using img's symbols and debug info when present.
+func Write(w io.Writer, p *vm.Profile, img *bytecode.Image) error {
+	b := newBuilder(img)
+	var samples []message
+	for _, s := range p.Samples() {
+		var sample message
+		var locs []uint64
+		for i, off := range s.Stack {
+			if i > 0 {
+				off = b.callSite(off)
+			}
+			locs = append(locs, b.location(off))
+		}
+		sample.packed(1, locs...)
+		sample.packed(2, uint64(s.Count))
+		samples = append(samples, sample)
+	}
+
+	var prof message
+	var sampleType message
+	sampleType.uint(1, b.str("instructions"))
+	sampleType.uint(2, b.str("count"))
+	prof.message(1, sampleType)
+	for _, s := range samples {
+		prof.message(2, s)
+	}
+	for _, l := range b.locations {
+		prof.message(4, l)
+	}
+	for _, f := range b.functions {
+		prof.message(5, f)
+	}
+	for _, s := range b.strings {
+		prof.bytes(6, []byte(s))
+	}
+	prof.message(11, sampleType)
+	prof.uint(12, 1)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(prof.buf); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type builder struct {
+	syms       *bytecode.SymbolTable
+	boundaries []int // instruction offsets in ascending order
+	entries    []int // function entry points in ascending order
+	strings    []string
+	stringIDs  map[string]uint64
+	locations  []message
+	locIDs     map[int]uint64
+	functions  []message
+	funcIDs    map[int]uint64
+}
+
+func newBuilder(img *bytecode.Image) *builder {
+	b := &builder{
+		syms:      bytecode.NewSymbolTable(img),
+		strings:   []string{""},
+		stringIDs: map[string]uint64{"": 0},
+		locIDs:    make(map[int]uint64),
+		funcIDs:   make(map[int]uint64),
+	}
+	entries := map[int]bool{img.Start: true}
+	for pos := 0; pos < len(img.Code); {
+		op, arg, size, err := bytecode.Decode(img.Code[pos:])
+		if err != nil {
+			break
+		}
+		b.boundaries = append(b.boundaries, pos)
+		if op == bytecode.OpCall {
+			entries[int(arg.(int64))] = true
+		}
+		pos += size
+	}
+	for off := range entries {
+		b.entries = append(b.entries, off)
+	}
+	sort.Ints(b.entries)
+	return b
+}
+
+func (b *builder) str(s string) uint64 {
+	if id, ok := b.stringIDs[s]; ok {
+		return id
+	}
+	id := uint64(len(b.strings))
+	b.strings = append(b.strings, s)
+	b.stringIDs[s] = id
+	return id
+}
+
+// callSite returns the offset of the call instruction preceding return address ret.
+func (b *builder) callSite(ret int) int {
+	i := sort.SearchInts(b.boundaries, ret)
+	if i == 0 {
+		return ret
+	}
+	return b.boundaries[i-1]
+}
+
+// entry returns the entry point of the function containing off.
+func (b *builder) entry(off int) int {
+	i := sort.Search(len(b.entries), func(i int) bool { return b.entries[i] > off })
+	if i == 0 {
+		return 0
+	}
+	return b.entries[i-1]
+}
+
+func (b *builder) function(entry int) uint64 {
+	if id, ok := b.funcIDs[entry]; ok {
+		return id
+	}
+	id := uint64(len(b.functions) + 1)
+	name, ok := b.syms.Label(entry)
+	if !ok {
+		name = fmt.Sprintf("sub_%04d", entry)
+	}
+	var f message
+	f.uint(1, id)
+	f.uint(2, b.str(name))
+	f.uint(3, b.str(name))
+	if l, ok := b.syms.Line(entry); ok {
+		f.uint(4, b.str(b.syms.SourceFile(entry)))
+		f.uint(5, uint64(l.Line))
+	}
+	b.functions = append(b.functions, f)
+	b.funcIDs[entry] = id
+	return id
+}
+
+func (b *builder) location(off int) uint64 {
+	if id, ok := b.locIDs[off]; ok {
+		return id
+	}
+	id := uint64(len(b.locations) + 1)
+	var line message
+	line.uint(1, b.function(b.entry(off)))
+	if l, ok := b.syms.Line(off); ok {
+		line.uint(2, uint64(l.Line))
+	}
+	var loc message
+	loc.uint(1, id)
+	loc.uint(3, uint64(off))
+	loc.message(4, line)
+	b.locations = append(b.locations, loc)
+	b.locIDs[off] = id
+	return id
+}
+
+// message is an encoded protocol buffer message.
+type message struct {
+	buf []byte
+}
+
+func (m *message) varint(n uint64) {
+	for n >= 0x80 {
+		m.buf = append(m.buf, byte(n)|0x80)
+		n >>= 7
+	}
+	m.buf = append(m.buf, byte(n))
+}
+
+func (m *message) uint(field int, n uint64) {
+	m.varint(uint64(field) << 3)
+	m.varint(n)
+}
+
+func (m *message) bytes(field int, b []byte) {
+	m.varint(uint64(field)<<3 | 2)
+	m.varint(uint64(len(b)))
+	m.buf = append(m.buf, b...)
+}
+
+func (m *message) message(field int, sub message) { m.bytes(field, sub.buf) }
+
+func (m *message) packed(field int, ns ...uint64) {
+	var p message
+	for _, n := range ns {
+		p.varint(n)
+	}
+	m.bytes(field, p.buf)
+}
@@ -0,0 +1,194 @@
+package pprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bruston/lil/asm"
+	"github.com/bruston/lil/vm"
+)
+
+// field is a decoded protocol buffer field, either a varint or bytes.
+type field struct {
+	num int
+	n   uint64
+	b   []byte
+}
+
+func decode(t *testing.T, b []byte) []field {
+	var fields []field
+	for len(b) > 0 {
+		tag, read := binary.Uvarint(b)
+		if read <= 0 {
+			t.Fatalf("malformed tag in %x", b)
+		}
+		b = b[read:]
+		f := field{num: int(tag >> 3)}
+		n, read := binary.Uvarint(b)
+		if read <= 0 {
+			t.Fatalf("malformed field %d", f.num)
+		}
+		b = b[read:]
+		switch tag & 7 {
+		case 0:
+			f.n = n
+		case 2:
+			if uint64(len(b)) < n {
+				t.Fatalf("field %d is truncated", f.num)
+			}
+			f.b, b = b[:n], b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d for field %d", tag&7, f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func packed(t *testing.T, b []byte) []uint64 {
+	var ns []uint64
+	for len(b) > 0 {
+		n, read := binary.Uvarint(b)
+		if read <= 0 {
+			t.Fatalf("malformed packed varint in %x", b)
+		}
+		ns = append(ns, n)
+		b = b[read:]
+	}
+	return ns
+}
+
+func TestWrite(t *testing.T) {
+	img, err := asm.Assemble(strings.NewReader(":sub\n\tpush_one\n\tdrop\n\tret\n:main\n\tcall sub\n\thalt\n"), asm.Options{File: "p.asm", Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := vm.Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Profile = vm.NewProfile()
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, m.Profile, img); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var strs []string
+	var sampleTypes, samples, locations, functions [][]byte
+	for _, f := range decode(t, raw) {
+		switch f.num {
+		case 1:
+			sampleTypes = append(sampleTypes, f.b)
+		case 2:
+			samples = append(samples, f.b)
+		case 4:
+			locations = append(locations, f.b)
+		case 5:
+			functions = append(functions, f.b)
+		case 6:
+			strs = append(strs, string(f.b))
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("expecting the string table to start with the empty string, got %q", strs)
+	}
+	str := func(n uint64) string {
+		if n >= uint64(len(strs)) {
+			t.Fatalf("string index %d out of range", n)
+		}
+		return strs[n]
+	}
+	if len(sampleTypes) != 1 {
+		t.Fatalf("expecting 1 sample type, got %d", len(sampleTypes))
+	}
+	var typ []string
+	for _, f := range decode(t, sampleTypes[0]) {
+		typ = append(typ, str(f.n))
+	}
+	if expected := []string{"instructions", "count"}; !reflect.DeepEqual(typ, expected) {
+		t.Errorf("expecting sample type %q, got %q", expected, typ)
+	}
+
+	funcs := make(map[uint64]string)
+	for _, fn := range functions {
+		var id uint64
+		var name string
+		for _, f := range decode(t, fn) {
+			switch f.num {
+			case 1:
+				id = f.n
+			case 2:
+				name = str(f.n)
+			}
+		}
+		funcs[id] = name
+	}
+	// Each location is formatted as function:line@address.
+	locs := make(map[uint64]string)
+	for _, loc := range locations {
+		var id, addr, fn, line uint64
+		for _, f := range decode(t, loc) {
+			switch f.num {
+			case 1:
+				id = f.n
+			case 3:
+				addr = f.n
+			case 4:
+				for _, lf := range decode(t, f.b) {
+					switch lf.num {
+					case 1:
+						fn = lf.n
+					case 2:
+						line = lf.n
+					}
+				}
+			}
+		}
+		locs[id] = fmt.Sprintf("%s:%d@%d", funcs[fn], line, addr)
+	}
+	var got []string
+	for _, s := range samples {
+		var stack []string
+		var count []uint64
+		for _, f := range decode(t, s) {
+			switch f.num {
+			case 1:
+				for _, id := range packed(t, f.b) {
+					stack = append(stack, locs[id])
+				}
+			case 2:
+				count = packed(t, f.b)
+			}
+		}
+		got = append(got, fmt.Sprintf("%s %v", strings.Join(stack, " "), count))
+	}
+	sort.Strings(got)
+	expected := []string{
+		"main:6@3 [1]",
+		"main:7@5 [1]",
+		"sub:2@0 main:6@3 [1]",
+		"sub:3@1 main:6@3 [1]",
+		"sub:4@2 main:6@3 [1]",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expecting samples:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,12 @@
+; copies standard input to standard output a byte at a time
+:main
+:loop
+    read_byte
+    dup
+    push_int64 -1
+    jump_eq end
+    print_ch
+    jump loop
+:end
+    drop
+    halt
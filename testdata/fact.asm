@@ -0,0 +1,22 @@
+; recursive factorial using frame locals
+.func fact args=1 locals=1
+	load_local 0
+	push_one
+	jump_gt recurse
+	push_one
+	ret
+:recurse
+	load_local 0
+	dec
+	call fact
+	load_local 0
+	mul
+	ret
+
+.func main locals=1
+	push_int64 10
+	store_local 0
+	load_local 0
+	call fact
+	print
+	halt
@@ -0,0 +1,28 @@
+; 64-bit FNV-1a hash of a string
+.const OFFSET 0xcbf29ce484222325
+.const PRIME 0x100000001b3
+
+var text "hello, world"
+
+.func main locals=2
+	push_uint64 OFFSET
+	store_local 0
+:loop
+	load_local 0
+	load text
+	load_local 1
+	array_load
+	to_uint64
+	xor
+	push_uint64 PRIME
+	mul
+	store_local 0
+	load_local 1
+	inc
+	dup
+	store_local 1
+	push_int64 12
+	jump_lt loop
+	load_local 0
+	print
+	halt
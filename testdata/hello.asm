@@ -0,0 +1,26 @@
+; prints an initialised string and the sum of an initialised table
+var greeting "hello, world\n"
+var table 3, 4, 5
+var total 0
+var i 0
+:main
+    load greeting
+    print_str
+:loop
+    load table
+    load i
+    array_load
+    load total
+    add
+    store total
+    load i
+    inc
+    dup
+    store i
+    push_int64 3
+    jump_lt loop
+    load total
+    print
+    push_uint8 10
+    print_ch
+    halt
@@ -0,0 +1,31 @@
+; square root of 2 by Newton's method: x = (x + n/x) / 2
+.const ITERATIONS 6
+
+.func sqrt args=1 locals=2
+	push_float64 1.0
+	store_local 1
+	push_int64 ITERATIONS
+	store_local 2
+:step
+	load_local 1
+	load_local 0
+	load_local 1
+	div
+	add
+	push_float64 0.5
+	mul
+	store_local 1
+	load_local 2
+	dec
+	dup
+	store_local 2
+	jump_true step
+	load_local 1
+	ret
+
+.func main
+	push_int64 2
+	to_float64
+	call sqrt
+	print
+	halt
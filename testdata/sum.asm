@@ -0,0 +1,19 @@
+; prints the sum of the integers on standard input
+:main
+    var total
+    push_zero
+    store total
+:next
+    read_int
+    jump_true got
+    drop
+    load total
+    print
+    push_uint8 10
+    print_ch
+    halt
+:got
+    load total
+    add
+    store total
+    jump next
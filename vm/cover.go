@@ -0,0 +1,31 @@
+package vm
+
+// Coverage records which instructions a machine executed and which way each
+// conditional branch went. Set Machine.Coverage to a Coverage returned by
+// NewCoverage to collect it; coverage accumulates across runs.
+type Coverage struct {
+	Hits     map[int]int64        // executions by instruction offset
+	Branches map[int]*BranchCount // by offset of the conditional branch
+}
+
+// BranchCount is the number of times a conditional branch was and wasn't taken.
+type BranchCount struct {
+	Taken, NotTaken int64
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{Hits: make(map[int]int64), Branches: make(map[int]*BranchCount)}
+}
+
+func (c *Coverage) branch(ip int, taken bool) {
+	b, ok := c.Branches[ip]
+	if !ok {
+		b = &BranchCount{}
+		c.Branches[ip] = b
+	}
+	if taken {
+		b.Taken++
+	} else {
+		b.NotTaken++
+	}
+}
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+var (
+	ErrInvalidVarint      = errors.New("supplied varint is invalid")
+	ErrDivideByZero       = errors.New("division by zero")
+	ErrIndexOutOfRange    = errors.New("array index out of range")
+	ErrInvalidArrayLength = errors.New("invalid array length")
+)
+
+// TypeError is returned when an instruction is given an operand of the wrong
+// type. Its message leaves out Op, which the RuntimeError wrapping it names.
+type TypeError struct {
+	Op   string
+	Want string
+	Got  ValueType
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("expecting %s operand, got %s", e.Want, typeName(e.Got))
+}
+
+// traceDepth is the number of operand stack values captured by a RuntimeError.
+const traceDepth = 8
+
+// RuntimeError describes an error encountered while executing an instruction,
+// along with a snapshot of the machine at the time.
+type RuntimeError struct {
+	IP          int
+	Op          string
+	Instruction string  // the instruction and its operand, symbolised where possible
+	Position    string  // file:line of the instruction, if the image has debug info
+	Stack       []Value // top of the operand stack first, at most traceDepth values
+	StackLen    int     // depth of the operand stack
+	CallStack   []int   // return addresses, innermost first
+	Err         error
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Position != "" {
+		return fmt.Sprintf("%s %s: %v", e.Position, e.Instruction, e.Err)
+	}
+	return fmt.Sprintf("%s at %04d: %v", e.Op, e.IP, e.Err)
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// Trace returns a multi-line description of the error and the machine state.
+func (e *RuntimeError) Trace() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "runtime error: %v\n", e.Err)
+	if e.Position != "" {
+		fmt.Fprintf(&buf, "  at %04d %s %s\n", e.IP, e.Position, e.Instruction)
+	} else {
+		fmt.Fprintf(&buf, "  at %04d %s\n", e.IP, e.Instruction)
+	}
+	fmt.Fprintf(&buf, "stack (%d values, top first):\n", e.StackLen)
+	for i, v := range e.Stack {
+		fmt.Fprintf(&buf, "  %d: %v\n", i, v)
+	}
+	if e.StackLen > len(e.Stack) {
+		fmt.Fprintf(&buf, "  ... %d more\n", e.StackLen-len(e.Stack))
+	}
+	if len(e.CallStack) > 0 {
+		fmt.Fprintln(&buf, "call stack (innermost first):")
+		for _, ret := range e.CallStack {
+			fmt.Fprintf(&buf, "  return to %04d\n", ret)
+		}
+	}
+	return buf.String()
+}
+
+func opName(op byte) string {
+	if ins, ok := bytecode.Lookup(op); ok {
+		return ins.Name
+	}
+	return fmt.Sprintf("op(%d)", op)
+}
+
+func (m *Machine) runtimeError(ip int, err error) *RuntimeError {
+	e := &RuntimeError{IP: ip, Err: err, StackLen: m.Stack.Len(), Position: m.Symbols.Position(ip)}
+	if ip >= 0 && ip < len(m.Instructions) {
+		e.Op = opName(m.Instructions[ip])
+		e.Instruction = e.Op
+		if op, arg, _, err := bytecode.Decode(m.Instructions[ip:]); err == nil {
+			e.Instruction = m.Symbols.Instruction(op, arg)
+		}
+	}
+	for i := m.Stack.top; i >= 0 && len(e.Stack) < traceDepth; i-- {
+		e.Stack = append(e.Stack, m.Stack.elements[i])
+	}
+	for i := m.CallStack.top; i >= 0; i-- {
+		if f, ok := m.CallStack.elements[i].(*Frame); ok {
+			e.CallStack = append(e.CallStack, f.Return)
+		}
+	}
+	return e
+}
@@ -0,0 +1,74 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxLocals bounds the number of locals enter may allocate.
+const maxLocals = 1 << 16
+
+var ErrInvalidLocal = errors.New("local index out of range")
+
+// Frame is the activation record of a call, kept on the call stack. Its
+// locals are allocated by the enter instruction at the start of the callee:
+// the arguments the caller pushed, in the order they were pushed, followed by
+// the callee's own local slots. Values the callee leaves on the operand stack
+// when it returns are its results.
+type Frame struct {
+	ValueType
+	Return int     // offset of the instruction following the call
+	Locals []Value // nil until enter executes
+}
+
+func (f *Frame) Value() interface{} { return f.Return }
+
+func (f *Frame) String() string {
+	return fmt.Sprintf("frame(return %04d, %d locals)", f.Return, len(f.Locals))
+}
+
+func newFrame(ret int) *Frame { return &Frame{ValueType: ValueFrame, Return: ret} }
+
+// frame returns the innermost call frame, or the root frame of code running
+// outside any call.
+func (m *Machine) frame() *Frame {
+	if v, err := m.CallStack.Peek(); err == nil {
+		if f, ok := v.(*Frame); ok {
+			return f
+		}
+	}
+	if m.root == nil {
+		m.root = newFrame(-1)
+	}
+	return m.root
+}
+
+// enter replaces the locals of the current frame with args arguments,
+// popped from the operand stack, followed by locals slots initialised to
+// zero.
+func (m *Machine) enter(args, locals int64) error {
+	if args < 0 || locals < 0 || args+locals > maxLocals {
+		return ErrInvalidLocal
+	}
+	if int(args) > m.Stack.Len() {
+		return ErrStackUnderflow
+	}
+	f := m.frame()
+	f.Locals = make([]Value, args+locals)
+	for i := args - 1; i >= 0; i-- {
+		f.Locals[i], _ = m.Stack.Pop()
+	}
+	for i := args; i < args+locals; i++ {
+		f.Locals[i] = Int64{ValueInt64, 0}
+	}
+	return nil
+}
+
+// local returns a pointer to local slot n of the current frame.
+func (m *Machine) local(n int64) (*Value, error) {
+	f := m.frame()
+	if n < 0 || n >= int64(len(f.Locals)) {
+		return nil, ErrInvalidLocal
+	}
+	return &f.Locals[n], nil
+}
@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// input returns the buffered reader over Stdin, replacing it if Stdin has
+// changed since the last read.
+func (m *Machine) input() *bufio.Reader {
+	if m.in == nil || m.inSrc != m.Stdin {
+		m.in = bufio.NewReader(m.Stdin)
+		m.inSrc = m.Stdin
+	}
+	return m.in
+}
+
+func boolValue(ok bool) Int64 {
+	if ok {
+		return Int64{ValueInt64, 1}
+	}
+	return Int64{ValueInt64, 0}
+}
+
+func isSpace(b byte) bool { return b == ' ' || b == '\t' || b == '\n' || b == '\r' }
+
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+
+// readInt reads an optionally signed decimal integer from Stdin, skipping
+// leading white space. It reports false if the input ends before one starts,
+// or if what follows is not a number that fits in an int64, in which case it
+// is left unread.
+func (m *Machine) readInt() (int64, bool, error) {
+	in := m.input()
+	b, err := in.ReadByte()
+	for err == nil && isSpace(b) {
+		b, err = in.ReadByte()
+	}
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("reading input: %w", err)
+	}
+	in.UnreadByte()
+	// The number is peeked at and only read once it has parsed.
+	size := 0
+	b, err = peekByte(in, size)
+	if err == nil && (b == '-' || b == '+') {
+		size++
+		b, err = peekByte(in, size)
+	}
+	for err == nil && isDigit(b) {
+		size++
+		b, err = peekByte(in, size)
+	}
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return 0, false, fmt.Errorf("reading input: %w", err)
+	}
+	digits, _ := in.Peek(size)
+	n, perr := strconv.ParseInt(string(digits), 10, 64)
+	if perr != nil {
+		return 0, false, nil
+	}
+	in.Discard(size)
+	return n, true, nil
+}
+
+// peekByte returns the byte i bytes ahead of in without reading it.
+func peekByte(in *bufio.Reader, i int) (byte, error) {
+	b, err := in.Peek(i + 1)
+	if len(b) > i {
+		return b[i], nil
+	}
+	return 0, err
+}
+
+// readLine reads a line from Stdin as an array of Uint8, without its line
+// ending. It reports false if the input has ended.
+func (m *Machine) readLine() (*Array, bool, error) {
+	line, err := m.input().ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, false, fmt.Errorf("reading input: %w", err)
+	}
+	if err == io.EOF && len(line) == 0 {
+		return &Array{ValueArray, []Value{}}, false, nil
+	}
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n > 1 && line[n-2] == '\r' {
+			line = line[:n-2]
+		}
+	}
+	a := &Array{ValueArray, make([]Value, len(line))}
+	for i, b := range line {
+		a.elements[i] = Uint8{ValueUint8, b}
+	}
+	return a, true, nil
+}
@@ -0,0 +1,254 @@
+package vm
+
+import "math"
+
+// The numeric types form a tower, from lowest to highest rank:
+//
+//	uint8 < int64 < uint64 < float64
+//
+// Arithmetic (add, sub, mul, div, mod) and bitwise (and, or, xor) operations
+// on two numbers of different types first convert the lower ranked operand
+// to the type of the higher, and the result has that type. Bitwise
+// operations accept integers only.
+//
+// Integer arithmetic, inc and dec wrap around on overflow in the result
+// type, as do conversions from int64 to uint64 made by promotion: -1 becomes
+// the largest uint64. Integer division or mod by zero is an error. Float64
+// arithmetic follows IEEE 754, so division by zero gives an infinity or NaN.
+// The explicit conversion instructions accept any number and never wrap:
+// to_int64, to_uint8 and to_uint64 fail if the value is out of range of the
+// target type, and truncate float64 towards zero. Converting a number to its
+// own type leaves it unchanged.
+//
+// Comparisons (jump_eq, jump_ne, jump_lt and jump_gt) do not promote. They
+// compare numbers of any types by their exact mathematical values, so int64
+// -1 is less than every uint64 and uint8 1 equals float64 1. NaN is
+// unordered and equal to nothing, itself included.
+
+// rank returns the position of v's type in the numeric tower, or -1 if v is
+// not a number.
+func rank(v Value) int {
+	switch v.(type) {
+	case Uint8:
+		return 0
+	case Int64:
+		return 1
+	case Uint64:
+		return 2
+	case Float64:
+		return 3
+	}
+	return -1
+}
+
+// notNumber returns a TypeError for op naming whichever of a and b is not a
+// number.
+func notNumber(op string, a, b Value) error {
+	if rank(a) < 0 {
+		return &TypeError{op, "number", a.Type()}
+	}
+	return &TypeError{op, "number", b.Type()}
+}
+
+// promote converts the lower ranked of two numbers to the type of the other,
+// reporting false if either is not a number.
+func promote(a, b Value) (Value, Value, bool) {
+	ra, rb := rank(a), rank(b)
+	switch {
+	case ra < 0 || rb < 0:
+		return a, b, false
+	case ra < rb:
+		return convert(a, rb), b, true
+	}
+	return a, convert(b, ra), true
+}
+
+// convert converts the number v to the type at rank r, which is at least
+// v's own.
+func convert(v Value, r int) Value {
+	if rank(v) == r {
+		return v
+	}
+	var i int64
+	switch n := v.(type) {
+	case Uint8:
+		i = int64(n.Val)
+	case Int64:
+		i = n.Val
+	case Uint64:
+		return Float64{ValueFloat64, float64(n.Val)}
+	}
+	switch r {
+	case 1:
+		return Int64{ValueInt64, i}
+	case 2:
+		return Uint64{ValueUint64, uint64(i)}
+	}
+	return Float64{ValueFloat64, float64(i)}
+}
+
+// integer returns the value of an integer: i for uint8 and int64, u for
+// uint64.
+func integer(v Value) (i int64, u uint64, unsigned bool) {
+	switch n := v.(type) {
+	case Uint8:
+		return int64(n.Val), 0, false
+	case Int64:
+		return n.Val, 0, false
+	case Uint64:
+		return 0, n.Val, true
+	}
+	return 0, 0, false
+}
+
+// compareNumbers compares two numbers by their exact values, returning -1, 0
+// or 1, or 2 if either is NaN and so they are unordered. It reports false if
+// either is not a number.
+func compareNumbers(a, b Value) (int, bool) {
+	if rank(a) < 0 || rank(b) < 0 {
+		return 0, false
+	}
+	fa, aFloat := a.(Float64)
+	fb, bFloat := b.(Float64)
+	switch {
+	case aFloat && bFloat:
+		return compareFloats(fa.Val, fb.Val), true
+	case aFloat:
+		if c := compareIntFloat(b, fa.Val); c != 2 {
+			return -c, true
+		}
+		return 2, true
+	case bFloat:
+		return compareIntFloat(a, fb.Val), true
+	}
+	ai, au, aUnsigned := integer(a)
+	bi, bu, bUnsigned := integer(b)
+	switch {
+	case !aUnsigned && !bUnsigned:
+		return compareInt64(ai, bi), true
+	case aUnsigned && bUnsigned:
+		return compareUint64(au, bu), true
+	case aUnsigned:
+		if bi < 0 {
+			return 1, true
+		}
+		return compareUint64(au, uint64(bi)), true
+	}
+	if ai < 0 {
+		return -1, true
+	}
+	return compareUint64(uint64(ai), bu), true
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case math.IsNaN(a) || math.IsNaN(b):
+		return 2
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareIntFloat compares the integer v with f exactly, rather than by
+// converting v to a float64, which may round it. The integer part of f is
+// compared first, then its fraction breaks a tie.
+func compareIntFloat(v Value, f float64) int {
+	if math.IsNaN(f) {
+		return 2
+	}
+	i, u, unsigned := integer(v)
+	t := math.Trunc(f)
+	var c int
+	switch {
+	case unsigned && f < 0:
+		return 1
+	case unsigned && f >= 1<<64:
+		return -1
+	case unsigned:
+		c = compareUint64(u, uint64(t))
+	case f < -(1 << 63):
+		return 1
+	case f >= 1<<63:
+		return -1
+	default:
+		c = compareInt64(i, int64(t))
+	}
+	switch {
+	case c != 0:
+		return c
+	case f > t:
+		return -1
+	case f < t:
+		return 1
+	}
+	return 0
+}
+
+// equal reports whether a and b are equal: numbers by their exact values,
+// arrays by their elements and other values by identity.
+func equal(a, b Value) bool { return equalSeen(a, b, nil) }
+
+// equalSeen is equal, where seen holds the pairs of arrays already being
+// compared. They are taken to be equal, as in reflect.DeepEqual, so that
+// arrays containing themselves can be compared.
+func equalSeen(a, b Value, seen map[[2]*Array]bool) bool {
+	if c, ok := compareNumbers(a, b); ok {
+		return c == 0
+	}
+	x, xok := a.(*Array)
+	y, yok := b.(*Array)
+	switch {
+	case !xok || !yok:
+		return a == b
+	case x == y:
+		return true
+	case len(x.elements) != len(y.elements):
+		return false
+	}
+	key := [2]*Array{x, y}
+	if seen[key] {
+		return true
+	}
+	if seen == nil {
+		seen = make(map[[2]*Array]bool)
+	}
+	seen[key] = true
+	for i := range x.elements {
+		if !equalSeen(x.elements[i], y.elements[i], seen) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare is compareNumbers for Comparable, treating values that are not
+// numbers as unordered.
+func compare(a, b Value) int {
+	if c, ok := compareNumbers(a, b); ok {
+		return c
+	}
+	return 2
+}
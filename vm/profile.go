@@ -0,0 +1,73 @@
+package vm
+
+// Profile counts executed instructions by call stack. Set Machine.Profile to
+// a Profile returned by NewProfile to collect samples.
+type Profile struct {
+	root profileNode
+}
+
+// profileNode is a trie keyed by return address, outermost call first, with
+// the executing instruction's offset as the final key.
+type profileNode struct {
+	children map[int]*profileNode
+	count    int64
+}
+
+func (n *profileNode) child(off int) *profileNode {
+	if n.children == nil {
+		n.children = make(map[int]*profileNode)
+	}
+	c, ok := n.children[off]
+	if !ok {
+		c = &profileNode{}
+		n.children[off] = c
+	}
+	return c
+}
+
+func NewProfile() *Profile { return &Profile{} }
+
+// Sample is the number of times an instruction executed with a particular call stack.
+type Sample struct {
+	Stack []int // offset of the instruction, then return addresses innermost first
+	Count int64
+}
+
+func (p *Profile) record(m *Machine, ip int) {
+	n := &p.root
+	for i := 0; i <= m.CallStack.top; i++ {
+		if f, ok := m.CallStack.elements[i].(*Frame); ok {
+			n = n.child(f.Return)
+		}
+	}
+	n.child(ip).count++
+}
+
+// Samples returns every sample recorded so far.
+func (p *Profile) Samples() []Sample {
+	var samples []Sample
+	var walk func(n *profileNode, path []int)
+	walk = func(n *profileNode, path []int) {
+		if n.count > 0 {
+			stack := make([]int, len(path))
+			for i, off := range path {
+				stack[len(path)-1-i] = off
+			}
+			samples = append(samples, Sample{stack, n.count})
+		}
+		for off, c := range n.children {
+			walk(c, append(path, off))
+		}
+	}
+	walk(&p.root, nil)
+	return samples
+}
+
+// Counts returns the number of times each instruction offset executed.
+func (p *Profile) Counts() map[int]int64 {
+	counts := make(map[int]int64)
+	for _, s := range p.Samples() {
+		counts[s.Stack[0]] += s.Count
+	}
+	return counts
+}
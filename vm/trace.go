@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+// traceTop is the number of operand stack values included in a TraceRecord.
+const traceTop = 4
+
+// TraceRecord describes the machine just before an instruction executes.
+type TraceRecord struct {
+	Step        int64       `json:"step"`
+	IP          int         `json:"ip"`
+	Op          string      `json:"op"`
+	Operand     interface{} `json:"operand,omitempty"`
+	Instruction string      `json:"instruction"` // symbolised where possible
+	Position    string      `json:"pos,omitempty"`
+	Depth       int         `json:"depth"`
+	Top         []string    `json:"top"` // top of the operand stack first
+}
+
+// A Tracer receives a record for every instruction the machine executes. An
+// error returned by Trace stops execution.
+type Tracer interface {
+	Trace(TraceRecord) error
+}
+
+func (m *Machine) traceRecord(ip int) TraceRecord {
+	r := TraceRecord{Step: m.Steps, IP: ip, Depth: m.Stack.Len(), Position: m.Symbols.Position(ip), Top: []string{}}
+	op, arg, _, err := bytecode.Decode(m.Instructions[ip:])
+	if err != nil {
+		r.Op = opName(m.Instructions[ip])
+		r.Instruction = r.Op
+	} else {
+		r.Op = opName(op)
+		r.Operand = arg
+		r.Instruction = m.Symbols.Instruction(op, arg)
+	}
+	for i := m.Stack.top; i >= 0 && len(r.Top) < traceTop; i-- {
+		r.Top = append(r.Top, fmt.Sprint(m.Stack.elements[i]))
+	}
+	return r
+}
+
+type textTracer struct {
+	w io.Writer
+}
+
+// NewTextTracer returns a Tracer that writes one human-readable line per
+// instruction to w.
+func NewTextTracer(w io.Writer) Tracer { return textTracer{w} }
+
+func (t textTracer) Trace(r TraceRecord) error {
+	line := fmt.Sprintf("%6d %04d %-24s depth=%-3d [%s]", r.Step, r.IP, r.Instruction, r.Depth, strings.Join(r.Top, " "))
+	if r.Position != "" {
+		line += " " + r.Position
+	}
+	_, err := fmt.Fprintln(t.w, line)
+	return err
+}
+
+type jsonTracer struct {
+	enc *json.Encoder
+}
+
+// NewJSONTracer returns a Tracer that writes one JSON object per instruction
+// to w, in JSON Lines form.
+func NewJSONTracer(w io.Writer) Tracer { return jsonTracer{json.NewEncoder(w)} }
+
+func (t jsonTracer) Trace(r TraceRecord) error { return t.enc.Encode(r) }
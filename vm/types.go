@@ -2,7 +2,8 @@ package vm
 
 import (
 	"fmt"
-	"reflect"
+	"strconv"
+	"strings"
 )
 
 type ValueType byte
@@ -12,10 +13,33 @@ const (
 	ValueUint8
 	ValueArray
 	ValuePair
+	ValueFrame
+	ValueFloat64
+	ValueUint64
 )
 
 func (vt ValueType) Type() ValueType { return vt }
 
+var typeNames = map[ValueType]string{
+	ValueInt64:   "int64",
+	ValueUint8:   "uint8",
+	ValueArray:   "array",
+	ValuePair:    "pair",
+	ValueFrame:   "frame",
+	ValueFloat64: "float64",
+	ValueUint64:  "uint64",
+}
+
+func typeName(vt ValueType) string {
+	if name, ok := typeNames[vt]; ok {
+		return name
+	}
+	return fmt.Sprintf("type(%d)", vt)
+}
+
+// Comparable is implemented by the numbers. Compare returns -1, 0 or 1 as
+// the receiver is less than, equal to or greater than the argument, or 2 if
+// they are unordered: either is NaN or the argument is not a number.
 type Comparable interface {
 	Compare(Value) int
 }
@@ -38,43 +62,36 @@ func (i Int64) Value() interface{} { return i.Val }
 
 func (i Int64) String() string { return fmt.Sprintf("%d", i.Val) }
 
-func (i Int64) Equal(v Value) bool {
-	switch n := v.Value().(type) {
-	case Int64:
-		return n.Value() == i.Val
-	case Uint8:
-		return int64(n.Value().(uint8)) == i.Val
-	}
-	return false
-}
+func (i Int64) Equal(v Value) bool { return equal(i, v) }
 
-func (i Int64) Compare(v Value) int {
-	switch n := v.(type) {
-	case Int64:
-		if i.Val < n.Val {
-			return -1
-		}
-		if i.Val == n.Val {
-			return 0
-		}
-		return 1
-	case Uint8:
-		if i.Val < int64(n.Val) {
-			return -1
-		}
-		if i.Val == int64(n.Val) {
-			return 0
-		}
-		return 1
-	}
-	return -2 // should never happen
+func (i Int64) Compare(v Value) int { return compare(i, v) }
+
+type Float64 struct {
+	ValueType
+	Val float64
 }
 
+func (f Float64) Value() interface{} { return f.Val }
+
+func (f Float64) String() string { return strconv.FormatFloat(f.Val, 'g', -1, 64) }
+
+func (f Float64) Equal(v Value) bool { return equal(f, v) }
+
+func (f Float64) Compare(v Value) int { return compare(f, v) }
+
 type Uint64 struct {
 	ValueType
 	Val uint64
 }
 
+func (u Uint64) Value() interface{} { return u.Val }
+
+func (u Uint64) String() string { return strconv.FormatUint(u.Val, 10) }
+
+func (u Uint64) Equal(v Value) bool { return equal(u, v) }
+
+func (u Uint64) Compare(v Value) int { return compare(u, v) }
+
 type Uint8 struct {
 	ValueType
 	Val uint8
@@ -84,26 +101,24 @@ func (u Uint8) Value() interface{} { return u.Val }
 
 func (u Uint8) String() string { return fmt.Sprintf("%d", u.Val) }
 
-func (u Uint8) Equal(v Value) bool {
-	switch v := v.(type) {
-	case Int64:
-		if v.Value().(int64) > 255 {
-			return false
-		}
-		return uint8(v.Value().(int64)) == u.Val
-	case Uint8:
-		return v.Value().(uint8) == u.Val
-	}
-	return false
-}
+func (u Uint8) Equal(v Value) bool { return equal(u, v) }
 
-func (u Uint8) Compare(v Value) int { return 0 }
+func (u Uint8) Compare(v Value) int { return compare(u, v) }
 
 type Array struct {
 	ValueType
 	elements []Value
 }
 
+// NewArray returns an array of n elements, each initialised to Int64 zero.
+func NewArray(n int) *Array {
+	a := &Array{ValueArray, make([]Value, n)}
+	for i := range a.elements {
+		a.elements[i] = Int64{ValueInt64, 0}
+	}
+	return a
+}
+
 func (a *Array) Value() interface{} { return a.elements }
 
 func (a *Array) Append(v Value) { a.elements = append(a.elements, v) }
@@ -116,13 +131,43 @@ func (a *Array) Len() int { return len(a.elements) }
 
 func (a *Array) Cap() int { return cap(a.elements) }
 
-func (a *Array) Equal(v Value) bool {
-	if v.Type() == ValueArray {
-		return reflect.DeepEqual(v.Value(), a.elements)
+func (a *Array) String() string {
+	var b strings.Builder
+	a.format(&b, nil)
+	return b.String()
+}
+
+// format writes a to b as fmt.Sprint would its elements, where seen holds the
+// arrays already being written. An array that contains itself is written as
+// [...] where it appears again, rather than recursing forever.
+func (a *Array) format(b *strings.Builder, seen map[*Array]bool) {
+	if seen[a] {
+		b.WriteString("[...]")
+		return
+	}
+	if seen == nil {
+		seen = make(map[*Array]bool)
 	}
-	return false
+	seen[a] = true
+	b.WriteByte('[')
+	for i, v := range a.elements {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		if el, ok := v.(*Array); ok {
+			el.format(b, seen)
+		} else {
+			fmt.Fprint(b, v)
+		}
+	}
+	b.WriteByte(']')
+	delete(seen, a)
 }
 
+// Equal reports whether v is an array of equal elements, comparing numbers
+// by value whatever their types.
+func (a *Array) Equal(v Value) bool { return equal(a, v) }
+
 type Pair struct {
 	ValueType
 	Elements [2]Value
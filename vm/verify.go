@@ -0,0 +1,145 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bruston/lil/bytecode"
+)
+
+var (
+	ErrInvalidTarget    = errors.New("branch target is not an instruction boundary")
+	ErrInvalidDataIndex = errors.New("data index out of range")
+)
+
+// VerifyError is returned when an image fails verification.
+type VerifyError struct {
+	Offset int
+	Err    error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verify: offset %04d: %v", e.Offset, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error { return e.Err }
+
+// unknownDepth marks an instruction whose operand stack depth cannot be
+// determined statically, such as the entry of a subroutine.
+const unknownDepth = -1
+
+type decoded struct {
+	op   byte
+	arg  interface{}
+	size int
+}
+
+// Verify checks that code decodes into whole instructions, that start and
+// every branch target fall on an instruction boundary, that data indices are
+// below dataElements and that no reachable instruction falls off the end of
+// the code. It also tracks the operand stack depth through each reachable
+// instruction, rejecting code that must underflow. Depth is not tracked
+// across call instructions, which are checked at run time instead.
+func Verify(code []byte, start, dataElements int) error {
+	program := make(map[int]decoded)
+	var offsets []int
+	for pos := 0; pos < len(code); {
+		op, arg, size, err := bytecode.Decode(code[pos:])
+		if err != nil {
+			return &VerifyError{pos, err}
+		}
+		program[pos] = decoded{op, arg, size}
+		offsets = append(offsets, pos)
+		pos += size
+	}
+	if len(code) == 0 {
+		return nil
+	}
+	if _, ok := program[start]; !ok {
+		return &VerifyError{start, errors.New("start offset is not an instruction boundary")}
+	}
+	for _, pos := range offsets {
+		ins := program[pos]
+		switch {
+		case bytecode.IsBranch(ins.op):
+			if _, ok := program[int(ins.arg.(int64))]; !ok {
+				return &VerifyError{pos, ErrInvalidTarget}
+			}
+		case ins.op == bytecode.OpLoad || ins.op == bytecode.OpStore:
+			if n := ins.arg.(int64); n < 0 || n >= int64(dataElements) {
+				return &VerifyError{pos, ErrInvalidDataIndex}
+			}
+		case ins.op == bytecode.OpMov:
+			for _, n := range ins.arg.([2]int64) {
+				if n < 0 || n >= int64(dataElements) {
+					return &VerifyError{pos, ErrInvalidDataIndex}
+				}
+			}
+		}
+	}
+	return verifyDepth(program, len(code), start)
+}
+
+func verifyDepth(program map[int]decoded, end, start int) error {
+	depths := map[int]int{start: 0}
+	work := []int{start}
+	enter := func(pos, depth int) {
+		old, seen := depths[pos]
+		switch {
+		case !seen:
+			depths[pos] = depth
+		case old != depth && old != unknownDepth:
+			depths[pos] = unknownDepth
+		default:
+			return
+		}
+		work = append(work, pos)
+	}
+	for len(work) > 0 {
+		pos := work[len(work)-1]
+		work = work[:len(work)-1]
+		ins := program[pos]
+		info, _ := bytecode.Lookup(ins.op)
+		depth := depths[pos]
+		pops := info.Pops
+		if ins.op == bytecode.OpEnter {
+			pops = int(ins.arg.([2]int64)[0])
+		}
+		if depth != unknownDepth {
+			if depth < pops {
+				return &VerifyError{pos, ErrStackUnderflow}
+			}
+			depth += info.Pushes - pops
+		}
+		next := pos + ins.size
+		switch ins.op {
+		case bytecode.OpHalt, bytecode.OpRet:
+			continue
+		case bytecode.OpJump:
+			enter(int(ins.arg.(int64)), depth)
+			continue
+		case bytecode.OpCall:
+			enter(int(ins.arg.(int64)), unknownDepth)
+			depth = unknownDepth
+		default:
+			if bytecode.IsBranch(ins.op) {
+				enter(int(ins.arg.(int64)), depth)
+			}
+		}
+		if next >= end {
+			return &VerifyError{pos, ErrIPOutOfRange}
+		}
+		enter(next, depth)
+	}
+	return nil
+}
+
+// Verify verifies the machine's instructions against its Data, allowing Exec
+// to run them.
+func (m *Machine) Verify() error {
+	if err := Verify(m.Instructions, m.IP, len(m.Data)); err != nil {
+		return err
+	}
+	m.verified = true
+	return nil
+}
@@ -1,12 +1,15 @@
 package vm
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 	"os"
+	"time"
 
 	"github.com/bruston/lil/bytecode"
 )
@@ -21,30 +24,58 @@ type Stack struct {
 	elements []Value
 }
 
-func (s *Stack) Push(v Value) {
+var (
+	ErrStackOverflow  = errors.New("stack overflow")
+	ErrStackUnderflow = errors.New("stack underflow")
+)
+
+func (s *Stack) Push(v Value) error {
+	if s.top+1 >= len(s.elements) {
+		return ErrStackOverflow
+	}
 	s.top++
 	s.elements[s.top] = v
+	return nil
 }
 
-func (s *Stack) Pop() Value {
+func (s *Stack) Pop() (Value, error) {
+	if s.top < 0 {
+		return nil, ErrStackUnderflow
+	}
 	v := s.elements[s.top]
 	s.elements[s.top] = nil
 	s.top--
-	return v
+	return v, nil
+}
+
+func (s *Stack) Len() int { return s.top + 1 }
+
+// Values returns a copy of the stack's contents, bottom first.
+func (s *Stack) Values() []Value {
+	return append([]Value(nil), s.elements[:s.top+1]...)
 }
 
-func (s *Stack) Peek() Value {
-	return s.elements[s.top]
+func (s *Stack) Peek() (Value, error) {
+	if s.top < 0 {
+		return nil, ErrStackUnderflow
+	}
+	return s.elements[s.top], nil
 }
 
-func (s *Stack) Swap() {
+func (s *Stack) Swap() error {
+	if s.top < 1 {
+		return ErrStackUnderflow
+	}
 	s.elements[s.top], s.elements[s.top-1] = s.elements[s.top-1], s.elements[s.top]
+	return nil
 }
 
-func (s *Stack) Dup() {
-	v := s.elements[s.top]
-	s.top++
-	s.elements[s.top] = v
+func (s *Stack) Dup() error {
+	v, err := s.Peek()
+	if err != nil {
+		return err
+	}
+	return s.Push(v)
 }
 
 func NewStack(size int) *Stack {
@@ -62,8 +93,22 @@ type Machine struct {
 	IP           int
 	SP           int
 	Stdin        io.Reader
-	Stdout       io.Writer
+	Stdout       io.Writer // written through a buffer that is flushed whenever Exec, Run or Step returns
 	Stderr       io.Writer
+	Steps        int64     // instructions executed so far
+	MaxSteps     int64     // if positive, execution stops once Steps reaches MaxSteps
+	Deadline     time.Time // if non-zero, execution stops once the deadline passes
+	Symbols      *bytecode.SymbolTable
+	Tracer       Tracer    // if non-nil, receives a record for every executed instruction
+	Profile      *Profile  // if non-nil, counts executed instructions
+	Coverage     *Coverage // if non-nil, records executed instructions and branch directions
+	state        State
+	err          error         // the error that left the machine Failed
+	out          *bufio.Writer // buffers writes to Stdout, flushed whenever run returns
+	in           *bufio.Reader // buffers reads from inSrc
+	inSrc        io.Reader
+	root         *Frame // locals of code running outside any call
+	verified     bool
 }
 
 func NewMachine(stackSize, callStackSize int) *Machine {
@@ -76,246 +121,808 @@ func NewMachine(stackSize, callStackSize int) *Machine {
 	}
 }
 
-var ErrInvalidVarint = errors.New("supplied varint is invalid")
+// index converts v to an array index, reporting a TypeError for non-integer values.
+func index(op string, v Value) (int, error) {
+	switch n := v.(type) {
+	case Int64:
+		return int(n.Val), nil
+	case Uint8:
+		return int(n.Val), nil
+	case Uint64:
+		if n.Val > uint64(^uint(0)>>1) {
+			return -1, nil
+		}
+		return int(n.Val), nil
+	}
+	return 0, &TypeError{op, "integer", v.Type()}
+}
+
+// truth reports whether v is a non-zero number.
+func truth(op string, v Value) (bool, error) {
+	switch n := v.(type) {
+	case Int64:
+		return n.Val != 0, nil
+	case Uint8:
+		return n.Val != 0, nil
+	case Uint64:
+		return n.Val != 0, nil
+	case Float64:
+		return n.Val != 0, nil
+	}
+	return false, &TypeError{op, "number", v.Type()}
+}
+
+var ErrIPOutOfRange = errors.New("instruction pointer out of range")
 
+// readVarint decodes the varint argument at IP and advances IP past it.
 func (m *Machine) readVarint() (int64, error) {
 	n, read := binary.Varint(m.Instructions[m.IP:])
 	if read <= 0 {
 		return 0, ErrInvalidVarint
 	}
-	m.IP += read - 1
+	m.IP += read
+	return n, nil
+}
+
+// readUvarint decodes the unsigned varint argument at IP and advances IP past
+// it.
+func (m *Machine) readUvarint() (uint64, error) {
+	n, read := binary.Uvarint(m.Instructions[m.IP:])
+	if read <= 0 {
+		return 0, ErrInvalidVarint
+	}
+	m.IP += read
 	return n, nil
 }
 
+// pop2 pops the top two values of the operand stack, returning them in the
+// order they were pushed.
+func (m *Machine) pop2() (a, b Value, err error) {
+	if b, err = m.Stack.Pop(); err != nil {
+		return nil, nil, err
+	}
+	if a, err = m.Stack.Pop(); err != nil {
+		return nil, nil, err
+	}
+	return a, b, nil
+}
+
+// jumpIf reads a branch target and moves IP to it when cond holds.
+func (m *Machine) jumpIf(cond func() (bool, error)) error {
+	at := m.IP - 1
+	n, err := m.readVarint()
+	if err != nil {
+		return err
+	}
+	ok, err := cond()
+	if err != nil {
+		return err
+	}
+	if m.Coverage != nil && bytecode.IsConditional(m.Instructions[at]) {
+		m.Coverage.branch(at, ok)
+	}
+	if ok {
+		m.IP = int(n)
+	}
+	return nil
+}
+
+var (
+	ErrBudgetExhausted = errors.New("instruction budget exhausted")
+	ErrHalted          = errors.New("machine has halted")
+)
+
+// State describes where a machine is in its execution.
+type State int
+
+const (
+	Ready  State = iota // loaded but not yet run
+	Paused              // stopped before halting; Exec, Run or Step resumes execution
+	Halted              // executed a halt instruction
+	Failed              // stopped by a runtime error
+)
+
+func (m *Machine) State() State { return m.state }
+
+// checkInterval is the number of instructions executed between checks for
+// cancellation and deadline expiry.
+const checkInterval = 1024
+
+// Exec runs the machine until it halts or an error occurs. The instructions
+// are verified before the first instruction executes.
 func (m *Machine) Exec() error {
+	return m.run(context.Background(), -1)
+}
+
+// ExecContext is like Exec but also stops, returning a RuntimeError wrapping
+// the context's error, when ctx is done or the machine's Deadline passes. If
+// MaxSteps is positive, execution stops with ErrBudgetExhausted once that
+// many instructions have been executed. In both cases the machine is left
+// Paused and may be resumed.
+func (m *Machine) ExecContext(ctx context.Context) error {
+	return m.run(ctx, -1)
+}
+
+// Run executes up to n instructions, leaving the machine Paused if it has not
+// halted by then.
+func (m *Machine) Run(n int) error {
+	return m.run(context.Background(), int64(n))
+}
+
+// Step executes exactly one instruction.
+func (m *Machine) Step() error {
+	return m.run(context.Background(), 1)
+}
+
+// run executes up to n instructions, or until the machine halts if n is negative.
+func (m *Machine) run(ctx context.Context, n int64) (err error) {
+	switch m.state {
+	case Halted:
+		return ErrHalted
+	case Failed:
+		return m.err
+	}
 	if len(m.Instructions) == 0 {
+		m.state = Halted
 		return nil
 	}
-	for {
-		switch m.Instructions[m.IP] {
-		case bytecode.OpPushZero:
-			m.Stack.Push(Int64{ValueInt64, 0})
-		case bytecode.OpPushOne:
-			m.Stack.Push(Int64{ValueInt64, 1})
-		case bytecode.OpPushUint8:
-			m.IP++
-			m.Stack.Push(Uint8{ValueUint8, m.Instructions[m.IP]})
-		case bytecode.OpPushInt64:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
-			}
-			m.Stack.Push(Int64{ValueInt64, n})
-		case bytecode.OpPrint:
-			v := m.Stack.Pop()
-			fmt.Fprint(os.Stdout, v)
-		case bytecode.OpPrintCh:
-			if m.Stack.Peek().Type() != ValueUint8 {
-				return errors.New("expecting Uint8 arg for PrintCh")
-			}
-			v := m.Stack.Pop()
-			fmt.Fprint(os.Stdout, string(v.Value().(uint8)))
-		case bytecode.OpDrop:
-			m.Stack.Pop()
-		case bytecode.OpStore:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
-			}
-			m.Data[int(n)] = m.Stack.Pop()
-		case bytecode.OpLoad:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
-			}
-			m.Stack.Push(m.Data[int(n)])
-		case bytecode.OpToInt64:
-			if m.Stack.Peek().Type() != ValueUint8 {
-				errors.New("cannot convert non-uint8 value to int64")
-			}
-			v := m.Stack.Pop()
-			m.Stack.Push(Int64{ValueInt64, int64(v.Value().(uint8))})
-		case bytecode.OpToUint8:
-			if m.Stack.Peek().Type() != ValueInt64 {
-				return errors.New("cannot convert non-int64 value to uint8")
-			}
-			v := m.Stack.Pop()
-			if v.Value().(int64) < 0 || v.Value().(int64) > 255 {
-				return errors.New("unable to convert int64 to uint8: outside of range: 0-255")
-			}
-			m.Stack.Push(Uint8{ValueUint8, uint8(v.Value().(int64))})
-		case bytecode.OpAdd:
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Type() != ValueInt64 || b.Type() != ValueInt64 {
-				return errors.New("attempted addition on non-int64 values")
-			}
-			m.Stack.Push(Int64{ValueInt64, a.Value().(int64) + b.Value().(int64)})
-		case bytecode.OpSub:
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Type() != ValueInt64 || b.Type() != ValueInt64 {
-				return errors.New("attempted subtraction on non-int64 values")
-			}
-			m.Stack.Push(Int64{ValueInt64, a.Value().(int64) - b.Value().(int64)})
-		case bytecode.OpMul:
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Type() != ValueInt64 || b.Type() != ValueInt64 {
-				return errors.New("attempted multiplication on non-int64 values")
-			}
-			m.Stack.Push(Int64{ValueInt64, a.Value().(int64) * b.Value().(int64)})
-		case bytecode.OpMod:
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Type() != ValueInt64 || b.Type() != ValueInt64 {
-				return errors.New("attempted mod on non-int64 values")
-			}
-			m.Stack.Push(Int64{ValueInt64, a.Value().(int64) % b.Value().(int64)})
-		case bytecode.OpSwap:
-			m.Stack.Swap()
-		case bytecode.OpDup:
-			m.Stack.Dup()
-		case bytecode.OpInc:
-			switch v := m.Stack.Pop().(type) {
-			case Int64:
-				v.Val++
-				m.Stack.Push(v)
-			case Uint8:
-				v.Val++
-				m.Stack.Push(v)
-			default:
-				return errors.New("attempted to increment a non-numeric type")
-			}
-		case bytecode.OpDec:
-			switch v := m.Stack.Pop().(type) {
-			case Int64:
-				v.Val--
-				m.Stack.Push(v)
-			case Uint8:
-				v.Val--
-				m.Stack.Push(v)
+	if !m.verified {
+		if err := m.Verify(); err != nil {
+			return err
+		}
+	}
+	if !m.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, m.Deadline)
+		defer cancel()
+	}
+	if m.out == nil {
+		m.out = bufio.NewWriter(m.Stdout)
+	} else {
+		m.out.Reset(m.Stdout)
+	}
+	ip := m.IP
+	defer func() { err = m.flush(ip, err) }()
+	done := ctx.Done()
+	m.state = Paused
+	for i := int64(0); n < 0 || i < n; i++ {
+		ip = m.IP
+		if m.MaxSteps > 0 && m.Steps >= m.MaxSteps {
+			return m.runtimeError(ip, ErrBudgetExhausted)
+		}
+		if done != nil && (i == 0 || m.Steps%checkInterval == 0) {
+			select {
+			case <-done:
+				return m.runtimeError(ip, ctx.Err())
 			default:
-				return errors.New("attempted to decrement a non-numeric type")
-			}
-		case bytecode.OpJump:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
-			}
-			m.IP = int(n) - 1
-		case bytecode.OpJumpTrue:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
 			}
-			v := m.Stack.Pop()
-			if v.Value() != 0 {
-				m.IP = int(n) - 1
-			}
-		case bytecode.OpJumpFalse:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
-			}
-			v := m.Stack.Pop()
-			if v.Value() == 0 {
-				m.IP = int(n) - 1
-			}
-		case bytecode.OpJumpEq:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
-			}
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Value() == b.Value() {
-				m.IP = int(n) - 1
-			}
-		case bytecode.OpJumpNotEq:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
-			}
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Value() != b.Value() {
-				m.IP = int(n) - 1
-			}
-		case bytecode.OpJumpLT:
-			m.IP++
-			n, err := m.readVarint()
-			if err != nil {
-				return err
+		}
+		if m.Profile != nil {
+			m.Profile.record(m, ip)
+		}
+		if m.Coverage != nil {
+			m.Coverage.Hits[ip]++
+		}
+		if m.Tracer != nil {
+			if err := m.Tracer.Trace(m.traceRecord(ip)); err != nil {
+				return m.runtimeError(ip, fmt.Errorf("trace: %w", err))
 			}
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			ac, ok := a.(Comparable)
+		}
+		halted, err := m.step()
+		m.Steps++
+		if err != nil {
+			m.state = Failed
+			m.err = m.runtimeError(ip, err)
+			return m.err
+		}
+		if halted {
+			m.state = Halted
+			return nil
+		}
+	}
+	return nil
+}
+
+// flush writes any buffered output, reporting a failure to do so as a runtime
+// error at ip unless err already reports one.
+func (m *Machine) flush(ip int, err error) error {
+	if ferr := m.out.Flush(); ferr != nil && err == nil {
+		m.state = Failed
+		m.err = m.runtimeError(ip, fmt.Errorf("writing output: %w", ferr))
+		return m.err
+	}
+	return err
+}
+
+// step executes the instruction at IP, reporting whether it halted the machine.
+// IP is advanced past the op code before the instruction executes, so argument
+// reads continue from IP and branches simply assign their target. The
+// instructions must have been verified.
+func (m *Machine) step() (bool, error) {
+	op := m.Instructions[m.IP]
+	m.IP++
+	switch op {
+	case bytecode.OpPushZero:
+		return false, m.Stack.Push(Int64{ValueInt64, 0})
+	case bytecode.OpPushOne:
+		return false, m.Stack.Push(Int64{ValueInt64, 1})
+	case bytecode.OpPushUint8:
+		n := m.Instructions[m.IP]
+		m.IP++
+		return false, m.Stack.Push(Uint8{ValueUint8, n})
+	case bytecode.OpPushInt64:
+		n, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		return false, m.Stack.Push(Int64{ValueInt64, n})
+	case bytecode.OpPushUint64:
+		n, err := m.readUvarint()
+		if err != nil {
+			return false, err
+		}
+		return false, m.Stack.Push(Uint64{ValueUint64, n})
+	case bytecode.OpPushFloat64:
+		bits := binary.LittleEndian.Uint64(m.Instructions[m.IP:])
+		m.IP += 8
+		return false, m.Stack.Push(Float64{ValueFloat64, math.Float64frombits(bits)})
+	case bytecode.OpPrint:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		if _, err := fmt.Fprint(m.out, v); err != nil {
+			return false, fmt.Errorf("writing output: %w", err)
+		}
+	case bytecode.OpPrintCh:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		if v.Type() != ValueUint8 {
+			return false, &TypeError{"print_ch", "uint8", v.Type()}
+		}
+		if _, err := fmt.Fprint(m.out, string(v.Value().(uint8))); err != nil {
+			return false, fmt.Errorf("writing output: %w", err)
+		}
+	case bytecode.OpPrintStr:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		a, ok := v.(*Array)
+		if !ok {
+			return false, &TypeError{"print_str", "array", v.Type()}
+		}
+		for _, el := range a.elements {
+			b, ok := el.(Uint8)
 			if !ok {
-				return errors.New("attempting to compare incomparable types")
+				return false, &TypeError{"print_str", "uint8 element", el.Type()}
 			}
-			if ac.Compare(b) == -1 {
-				m.IP = int(n) - 1
+			if err := m.out.WriteByte(b.Val); err != nil {
+				return false, fmt.Errorf("writing output: %w", err)
 			}
-		case bytecode.OpJumpGT:
-			m.IP++
-			n, err := m.readVarint()
+		}
+	case bytecode.OpReadByte:
+		b, err := m.input().ReadByte()
+		if err == io.EOF {
+			return false, m.Stack.Push(Int64{ValueInt64, -1})
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading input: %w", err)
+		}
+		return false, m.Stack.Push(Uint8{ValueUint8, b})
+	case bytecode.OpReadInt:
+		n, ok, err := m.readInt()
+		if err != nil {
+			return false, err
+		}
+		if err := m.Stack.Push(Int64{ValueInt64, n}); err != nil {
+			return false, err
+		}
+		return false, m.Stack.Push(boolValue(ok))
+	case bytecode.OpReadLine:
+		line, ok, err := m.readLine()
+		if err != nil {
+			return false, err
+		}
+		if err := m.Stack.Push(line); err != nil {
+			return false, err
+		}
+		return false, m.Stack.Push(boolValue(ok))
+	case bytecode.OpDrop:
+		_, err := m.Stack.Pop()
+		return false, err
+	case bytecode.OpStore:
+		n, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		m.Data[int(n)] = v
+	case bytecode.OpLoad:
+		n, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		return false, m.Stack.Push(m.Data[int(n)])
+	case bytecode.OpMov:
+		src, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		dst, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		m.Data[int(dst)] = m.Data[int(src)]
+	case bytecode.OpCreateArray:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		n, err := index("create_array", v)
+		if err != nil {
+			return false, err
+		}
+		if n < 0 {
+			return false, ErrInvalidArrayLength
+		}
+		return false, m.Stack.Push(NewArray(n))
+	case bytecode.OpArrayLoad:
+		v, i, err := m.pop2()
+		if err != nil {
+			return false, err
+		}
+		a, ok := v.(*Array)
+		if !ok {
+			return false, &TypeError{"array_load", "array", v.Type()}
+		}
+		n, err := index("array_load", i)
+		if err != nil {
+			return false, err
+		}
+		if n < 0 || n >= a.Len() {
+			return false, ErrIndexOutOfRange
+		}
+		return false, m.Stack.Push(a.Index(n))
+	case bytecode.OpArrayStore:
+		x, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		v, i, err := m.pop2()
+		if err != nil {
+			return false, err
+		}
+		a, ok := v.(*Array)
+		if !ok {
+			return false, &TypeError{"array_store", "array", v.Type()}
+		}
+		n, err := index("array_store", i)
+		if err != nil {
+			return false, err
+		}
+		if n < 0 || n >= a.Len() {
+			return false, ErrIndexOutOfRange
+		}
+		a.Set(n, x)
+	case bytecode.OpToInt64:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		switch v := v.(type) {
+		case Int64:
+			return false, m.Stack.Push(v)
+		case Uint8:
+			return false, m.Stack.Push(Int64{ValueInt64, int64(v.Val)})
+		case Uint64:
+			if v.Val > math.MaxInt64 {
+				return false, errors.New("unable to convert uint64 to int64: out of range")
+			}
+			return false, m.Stack.Push(Int64{ValueInt64, int64(v.Val)})
+		case Float64:
+			// Conversion truncates towards zero. The bounds are exact
+			// powers of two, so the comparisons are exact too.
+			if math.IsNaN(v.Val) || v.Val < -(1<<63) || v.Val >= 1<<63 {
+				return false, errors.New("unable to convert float64 to int64: out of range")
+			}
+			return false, m.Stack.Push(Int64{ValueInt64, int64(v.Val)})
+		}
+		return false, &TypeError{"to_int64", "number", v.Type()}
+	case bytecode.OpToUint64:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		switch v := v.(type) {
+		case Int64:
+			if v.Val < 0 {
+				return false, errors.New("unable to convert int64 to uint64: negative")
+			}
+			return false, m.Stack.Push(Uint64{ValueUint64, uint64(v.Val)})
+		case Uint8:
+			return false, m.Stack.Push(Uint64{ValueUint64, uint64(v.Val)})
+		case Uint64:
+			return false, m.Stack.Push(v)
+		case Float64:
+			if math.IsNaN(v.Val) || v.Val < 0 || v.Val >= 1<<64 {
+				return false, errors.New("unable to convert float64 to uint64: out of range")
+			}
+			return false, m.Stack.Push(Uint64{ValueUint64, uint64(v.Val)})
+		}
+		return false, &TypeError{"to_uint64", "number", v.Type()}
+	case bytecode.OpToFloat64:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		switch v := v.(type) {
+		case Int64:
+			return false, m.Stack.Push(Float64{ValueFloat64, float64(v.Val)})
+		case Uint8:
+			return false, m.Stack.Push(Float64{ValueFloat64, float64(v.Val)})
+		case Uint64:
+			return false, m.Stack.Push(Float64{ValueFloat64, float64(v.Val)})
+		case Float64:
+			return false, m.Stack.Push(v)
+		}
+		return false, &TypeError{"to_float64", "number", v.Type()}
+	case bytecode.OpToUint8:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		switch v := v.(type) {
+		case Int64:
+			if v.Val < 0 || v.Val > 255 {
+				return false, errors.New("unable to convert int64 to uint8: outside of range: 0-255")
+			}
+			return false, m.Stack.Push(Uint8{ValueUint8, uint8(v.Val)})
+		case Uint8:
+			return false, m.Stack.Push(v)
+		case Uint64:
+			if v.Val > 255 {
+				return false, errors.New("unable to convert uint64 to uint8: outside of range: 0-255")
+			}
+			return false, m.Stack.Push(Uint8{ValueUint8, uint8(v.Val)})
+		case Float64:
+			if math.IsNaN(v.Val) || v.Val < 0 || v.Val >= 256 {
+				return false, errors.New("unable to convert float64 to uint8: outside of range: 0-255")
+			}
+			return false, m.Stack.Push(Uint8{ValueUint8, uint8(v.Val)})
+		}
+		return false, &TypeError{"to_uint8", "number", v.Type()}
+	case bytecode.OpAdd:
+		return false, m.arith("add",
+			func(a, b int64) (int64, error) { return a + b, nil },
+			func(a, b uint64) (uint64, error) { return a + b, nil },
+			func(a, b float64) float64 { return a + b })
+	case bytecode.OpSub:
+		return false, m.arith("sub",
+			func(a, b int64) (int64, error) { return a - b, nil },
+			func(a, b uint64) (uint64, error) { return a - b, nil },
+			func(a, b float64) float64 { return a - b })
+	case bytecode.OpMul:
+		return false, m.arith("mul",
+			func(a, b int64) (int64, error) { return a * b, nil },
+			func(a, b uint64) (uint64, error) { return a * b, nil },
+			func(a, b float64) float64 { return a * b })
+	case bytecode.OpDiv:
+		return false, m.arith("div",
+			func(a, b int64) (int64, error) {
+				if b == 0 {
+					return 0, ErrDivideByZero
+				}
+				return a / b, nil
+			},
+			func(a, b uint64) (uint64, error) {
+				if b == 0 {
+					return 0, ErrDivideByZero
+				}
+				return a / b, nil
+			},
+			func(a, b float64) float64 { return a / b })
+	case bytecode.OpMod:
+		return false, m.arith("mod",
+			func(a, b int64) (int64, error) {
+				if b == 0 {
+					return 0, ErrDivideByZero
+				}
+				return a % b, nil
+			},
+			func(a, b uint64) (uint64, error) {
+				if b == 0 {
+					return 0, ErrDivideByZero
+				}
+				return a % b, nil
+			},
+			math.Mod)
+	case bytecode.OpSwap:
+		return false, m.Stack.Swap()
+	case bytecode.OpDup:
+		return false, m.Stack.Dup()
+	case bytecode.OpInc:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		switch v := v.(type) {
+		case Int64:
+			v.Val++
+			return false, m.Stack.Push(v)
+		case Uint8:
+			v.Val++
+			return false, m.Stack.Push(v)
+		case Uint64:
+			v.Val++
+			return false, m.Stack.Push(v)
+		case Float64:
+			v.Val++
+			return false, m.Stack.Push(v)
+		default:
+			return false, &TypeError{"inc", "number", v.Type()}
+		}
+	case bytecode.OpDec:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		switch v := v.(type) {
+		case Int64:
+			v.Val--
+			return false, m.Stack.Push(v)
+		case Uint8:
+			v.Val--
+			return false, m.Stack.Push(v)
+		case Uint64:
+			v.Val--
+			return false, m.Stack.Push(v)
+		case Float64:
+			v.Val--
+			return false, m.Stack.Push(v)
+		default:
+			return false, &TypeError{"dec", "number", v.Type()}
+		}
+	case bytecode.OpJump:
+		return false, m.jumpIf(func() (bool, error) { return true, nil })
+	case bytecode.OpJumpTrue:
+		return false, m.jumpIf(func() (bool, error) {
+			v, err := m.Stack.Pop()
 			if err != nil {
-				return err
-			}
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			ac, ok := a.(Comparable)
-			if !ok {
-				return errors.New("attempting to compare incomparable types")
-			}
-			if ac.Compare(b) == 1 {
-				m.IP = int(n) - 1
-			}
-		case bytecode.OpOr:
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Type() == ValueInt64 && b.Type() == ValueInt64 {
-				m.Stack.Push(Int64{ValueInt64, a.Value().(int64) | b.Value().(int64)})
-			} else if a.Type() == ValueUint8 && b.Type() == ValueUint8 {
-				m.Stack.Push(Uint8{ValueUint8, a.Value().(uint8) | b.Value().(uint8)})
-			} else {
-				return errors.New("attempting bitwise OR on different types")
-			}
-		case bytecode.OpAnd:
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Type() == ValueInt64 && b.Type() == ValueInt64 {
-				m.Stack.Push(Int64{ValueInt64, a.Value().(int64) & b.Value().(int64)})
-			} else if a.Type() == ValueUint8 && b.Type() == ValueUint8 {
-				m.Stack.Push(Uint8{ValueUint8, a.Value().(uint8) & b.Value().(uint8)})
-			} else {
-				return errors.New("attempting bitwise AND on incompatible types")
-			}
-		case bytecode.OpXOR:
-			b, a := m.Stack.Pop(), m.Stack.Pop()
-			if a.Type() == ValueInt64 && b.Type() == ValueInt64 {
-				m.Stack.Push(Int64{ValueInt64, a.Value().(int64) ^ b.Value().(int64)})
-			} else if a.Type() == ValueUint8 && b.Type() == ValueUint8 {
-				m.Stack.Push(Uint8{ValueUint8, a.Value().(uint8) ^ b.Value().(uint8)})
-			} else {
-				return errors.New("attempting bitwise XOR on incompatible types")
+				return false, err
 			}
-		case bytecode.OpCall:
-			m.CallStack.Push(Int64{ValueInt64, int64(m.IP)})
-			m.IP++
-			n, err := m.readVarint()
+			return truth("jump_true", v)
+		})
+	case bytecode.OpJumpFalse:
+		return false, m.jumpIf(func() (bool, error) {
+			v, err := m.Stack.Pop()
 			if err != nil {
-				return err
-			}
-			m.IP = int(n) - 1
-		case bytecode.OpRet:
-			m.IP = int(m.CallStack.Pop().Value().(int64))
-		case bytecode.OpNOP:
-		case bytecode.OpHalt:
-			return nil
+				return false, err
+			}
+			t, err := truth("jump_false", v)
+			return !t, err
+		})
+	case bytecode.OpJumpEq:
+		return false, m.jumpIf(func() (bool, error) {
+			a, b, err := m.pop2()
+			return err == nil && equal(a, b), err
+		})
+	case bytecode.OpJumpNotEq:
+		return false, m.jumpIf(func() (bool, error) {
+			a, b, err := m.pop2()
+			return err == nil && !equal(a, b), err
+		})
+	case bytecode.OpJumpLT:
+		return false, m.jumpIf(func() (bool, error) {
+			c, err := m.compare("jump_lt")
+			return c == -1, err
+		})
+	case bytecode.OpJumpGT:
+		return false, m.jumpIf(func() (bool, error) {
+			c, err := m.compare("jump_gt")
+			return c == 1, err
+		})
+	case bytecode.OpOr:
+		return false, m.bitwise("or", func(a, b uint64) uint64 { return a | b })
+	case bytecode.OpAnd:
+		return false, m.bitwise("and", func(a, b uint64) uint64 { return a & b })
+	case bytecode.OpXOR:
+		return false, m.bitwise("xor", func(a, b uint64) uint64 { return a ^ b })
+	case bytecode.OpNot:
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
 		}
-		m.IP++
+		switch v := v.(type) {
+		case Int64:
+			return false, m.Stack.Push(Int64{ValueInt64, ^v.Val})
+		case Uint8:
+			return false, m.Stack.Push(Uint8{ValueUint8, ^v.Val})
+		case Uint64:
+			return false, m.Stack.Push(Uint64{ValueUint64, ^v.Val})
+		default:
+			return false, &TypeError{"not", "integer", v.Type()}
+		}
+	case bytecode.OpShl:
+		return false, m.shift("shl")
+	case bytecode.OpShr:
+		return false, m.shift("shr")
+	case bytecode.OpCall:
+		n, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		if err := m.CallStack.Push(newFrame(m.IP)); err != nil {
+			return false, fmt.Errorf("call stack: %w", err)
+		}
+		m.IP = int(n)
+	case bytecode.OpRet:
+		v, err := m.CallStack.Pop()
+		if err != nil {
+			return false, fmt.Errorf("call stack: %w", err)
+		}
+		m.IP = v.(*Frame).Return
+	case bytecode.OpEnter:
+		args, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		locals, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		return false, m.enter(args, locals)
+	case bytecode.OpLoadLocal:
+		n, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		l, err := m.local(n)
+		if err != nil {
+			return false, err
+		}
+		return false, m.Stack.Push(*l)
+	case bytecode.OpStoreLocal:
+		n, err := m.readVarint()
+		if err != nil {
+			return false, err
+		}
+		l, err := m.local(n)
+		if err != nil {
+			return false, err
+		}
+		v, err := m.Stack.Pop()
+		if err != nil {
+			return false, err
+		}
+		*l = v
+	case bytecode.OpNOP:
+	case bytecode.OpHalt:
+		return true, nil
 	}
-	return nil
+	return false, nil
+}
+
+// compare pops two numbers and compares them, the first pushed being the
+// receiver. name describes the operation in errors.
+func (m *Machine) compare(name string) (int, error) {
+	a, b, err := m.pop2()
+	if err != nil {
+		return 0, err
+	}
+	c, ok := compareNumbers(a, b)
+	if !ok {
+		return 0, notNumber(name, a, b)
+	}
+	return c, nil
+}
+
+// arith pops two numbers, promotes them to a common type and pushes the
+// result of an arithmetic operation on them: ints for int64, uints for uint64
+// and uint8, truncating the result, and floats for float64. name describes
+// the instruction in errors.
+func (m *Machine) arith(name string, ints func(a, b int64) (int64, error), uints func(a, b uint64) (uint64, error), floats func(a, b float64) float64) error {
+	a, b, err := m.pop2()
+	if err != nil {
+		return err
+	}
+	x, y, ok := promote(a, b)
+	if !ok {
+		return notNumber(name, a, b)
+	}
+	switch x := x.(type) {
+	case Uint8:
+		n, err := uints(uint64(x.Val), uint64(y.(Uint8).Val))
+		if err != nil {
+			return err
+		}
+		return m.Stack.Push(Uint8{ValueUint8, uint8(n)})
+	case Int64:
+		n, err := ints(x.Val, y.(Int64).Val)
+		if err != nil {
+			return err
+		}
+		return m.Stack.Push(Int64{ValueInt64, n})
+	case Uint64:
+		n, err := uints(x.Val, y.(Uint64).Val)
+		if err != nil {
+			return err
+		}
+		return m.Stack.Push(Uint64{ValueUint64, n})
+	}
+	return m.Stack.Push(Float64{ValueFloat64, floats(x.(Float64).Val, y.(Float64).Val)})
+}
+
+// bitwise pops two integers, promotes them to a common type and pushes the
+// result of a bitwise operation on their bits.
+func (m *Machine) bitwise(name string, op func(a, b uint64) uint64) error {
+	a, b, err := m.pop2()
+	if err != nil {
+		return err
+	}
+	for _, v := range []Value{a, b} {
+		if r := rank(v); r < 0 || r > 2 {
+			return &TypeError{name, "integer", v.Type()}
+		}
+	}
+	x, y, _ := promote(a, b)
+	switch x := x.(type) {
+	case Uint8:
+		return m.Stack.Push(Uint8{ValueUint8, uint8(op(uint64(x.Val), uint64(y.(Uint8).Val)))})
+	case Int64:
+		return m.Stack.Push(Int64{ValueInt64, int64(op(uint64(x.Val), uint64(y.(Int64).Val)))})
+	}
+	return m.Stack.Push(Uint64{ValueUint64, op(x.(Uint64).Val, y.(Uint64).Val)})
+}
+
+var ErrNegativeShift = errors.New("negative shift count")
+
+// shift pops a shift count and an integer and pushes the integer shifted by
+// the count, left for shl and right for shr. Bits shifted out are lost; an
+// int64 is shifted right arithmetically, keeping its sign.
+func (m *Machine) shift(name string) error {
+	a, b, err := m.pop2()
+	if err != nil {
+		return err
+	}
+	var n uint64
+	switch b := b.(type) {
+	case Int64:
+		if b.Val < 0 {
+			return ErrNegativeShift
+		}
+		n = uint64(b.Val)
+	case Uint8:
+		n = uint64(b.Val)
+	case Uint64:
+		n = b.Val
+	default:
+		return &TypeError{name, "integer shift count", b.Type()}
+	}
+	left := name == "shl"
+	switch a := a.(type) {
+	case Int64:
+		if left {
+			return m.Stack.Push(Int64{ValueInt64, a.Val << n})
+		}
+		return m.Stack.Push(Int64{ValueInt64, a.Val >> n})
+	case Uint8:
+		if left {
+			return m.Stack.Push(Uint8{ValueUint8, a.Val << n})
+		}
+		return m.Stack.Push(Uint8{ValueUint8, a.Val >> n})
+	case Uint64:
+		if left {
+			return m.Stack.Push(Uint64{ValueUint64, a.Val << n})
+		}
+		return m.Stack.Push(Uint64{ValueUint64, a.Val >> n})
+	}
+	return &TypeError{name, "integer", a.Type()}
 }
 
 func Open(path string) (*Machine, error) {
@@ -324,16 +931,55 @@ func Open(path string) (*Machine, error) {
 		return nil, err
 	}
 	defer f.Close()
-	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
-	b, err := ioutil.ReadAll(f)
+	img, err := bytecode.ReadImage(f)
 	if err != nil {
 		return nil, err
 	}
-	n, size := binary.Varint(b)
-	m.IP = int(n)
-	m.Instructions = b[size:]
-	n, size = binary.Varint(m.Instructions)
-	m.Instructions = m.Instructions[size:]
-	m.Data = make([]Value, n)
+	return Load(img)
+}
+
+// Load returns a machine ready to execute img, with its data slots initialised
+// and its instructions verified.
+func Load(img *bytecode.Image) (*Machine, error) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.IP = img.Start
+	m.Instructions = img.Code
+	m.Data = make([]Value, img.DataElements)
+	m.Symbols = bytecode.NewSymbolTable(img)
+	for _, d := range img.Data {
+		if d.Slot < 0 || d.Slot >= len(m.Data) {
+			return nil, fmt.Errorf("data initialiser for slot %d: %w", d.Slot, ErrInvalidDataIndex)
+		}
+		v, err := constantValue(d.Value)
+		if err != nil {
+			return nil, err
+		}
+		m.Data[d.Slot] = v
+	}
+	if err := m.Verify(); err != nil {
+		return nil, err
+	}
 	return m, nil
 }
+
+func constantValue(c bytecode.Constant) (Value, error) {
+	switch c.Kind {
+	case bytecode.ConstInt64:
+		return Int64{ValueInt64, c.Int}, nil
+	case bytecode.ConstUint8:
+		return Uint8{ValueUint8, uint8(c.Int)}, nil
+	case bytecode.ConstFloat64:
+		return Float64{ValueFloat64, c.Float}, nil
+	case bytecode.ConstArray:
+		a := &Array{ValueArray, make([]Value, len(c.Elems))}
+		for i, el := range c.Elems {
+			v, err := constantValue(el)
+			if err != nil {
+				return nil, err
+			}
+			a.elements[i] = v
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown constant kind: %d", c.Kind)
+}
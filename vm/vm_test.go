@@ -0,0 +1,1069 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bruston/lil/asm"
+	"github.com/bruston/lil/bytecode"
+)
+
+type op struct {
+	code byte
+	arg  interface{}
+}
+
+func program(t *testing.T, ops ...op) []byte {
+	var buf bytes.Buffer
+	for _, o := range ops {
+		if _, err := bytecode.Encode(&buf, o.code, o.arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestExec(t *testing.T) {
+	for i, tt := range []struct {
+		ops      []op
+		data     int
+		expected Value
+		err      error
+	}{
+		{
+			[]op{{bytecode.OpPushInt64, int64(17)}, {bytecode.OpPushInt64, int64(5)}, {bytecode.OpDiv, nil}, {bytecode.OpHalt, nil}},
+			0, Int64{ValueInt64, 3}, nil,
+		},
+		{
+			[]op{{bytecode.OpPushInt64, int64(17)}, {bytecode.OpPushZero, nil}, {bytecode.OpDiv, nil}, {bytecode.OpHalt, nil}},
+			0, nil, ErrDivideByZero,
+		},
+		{
+			[]op{{bytecode.OpPushInt64, int64(17)}, {bytecode.OpPushZero, nil}, {bytecode.OpMod, nil}, {bytecode.OpHalt, nil}},
+			0, nil, ErrDivideByZero,
+		},
+		{
+			[]op{{bytecode.OpPushZero, nil}, {bytecode.OpNot, nil}, {bytecode.OpHalt, nil}},
+			0, Int64{ValueInt64, -1}, nil,
+		},
+		{
+			[]op{{bytecode.OpPushUint8, uint8(0x0f)}, {bytecode.OpNot, nil}, {bytecode.OpHalt, nil}},
+			0, Uint8{ValueUint8, 0xf0}, nil,
+		},
+		{
+			[]op{
+				{bytecode.OpPushInt64, int64(9)}, {bytecode.OpStore, int64(0)},
+				{bytecode.OpMov, [2]int64{0, 1}}, {bytecode.OpLoad, int64(1)}, {bytecode.OpHalt, nil},
+			},
+			2, Int64{ValueInt64, 9}, nil,
+		},
+		{
+			[]op{
+				{bytecode.OpPushInt64, int64(2)}, {bytecode.OpCreateArray, nil}, {bytecode.OpDup, nil},
+				{bytecode.OpPushOne, nil}, {bytecode.OpPushUint8, uint8(7)}, {bytecode.OpArrayStore, nil},
+				{bytecode.OpPushOne, nil}, {bytecode.OpArrayLoad, nil}, {bytecode.OpHalt, nil},
+			},
+			0, Uint8{ValueUint8, 7}, nil,
+		},
+		{
+			[]op{
+				{bytecode.OpPushInt64, int64(2)}, {bytecode.OpCreateArray, nil},
+				{bytecode.OpPushInt64, int64(2)}, {bytecode.OpArrayLoad, nil}, {bytecode.OpHalt, nil},
+			},
+			0, nil, ErrIndexOutOfRange,
+		},
+		{
+			[]op{{bytecode.OpPushInt64, int64(-1)}, {bytecode.OpCreateArray, nil}, {bytecode.OpHalt, nil}},
+			0, nil, ErrInvalidArrayLength,
+		},
+		{
+			[]op{{bytecode.OpPushZero, nil}, {bytecode.OpJumpTrue, int64(5)}, {bytecode.OpPushInt64, int64(7)}, {bytecode.OpHalt, nil}},
+			0, Int64{ValueInt64, 7}, nil,
+		},
+		{
+			[]op{{bytecode.OpPushZero, nil}, {bytecode.OpPushZero, nil}, {bytecode.OpJumpFalse, int64(6)}, {bytecode.OpPushInt64, int64(7)}, {bytecode.OpHalt, nil}},
+			0, Int64{ValueInt64, 0}, nil,
+		},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, tt.ops...)
+		m.Data = make([]Value, tt.data)
+		err := m.Exec()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%d. expecting error %v, got %v", i, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if v, _ := m.Stack.Peek(); v != tt.expected {
+			t.Errorf("%d. expecting %#v on top of stack, got %#v", i, tt.expected, v)
+		}
+	}
+}
+
+func TestFloat64(t *testing.T) {
+	f := func(v float64) op { return op{bytecode.OpPushFloat64, v} }
+	halt := op{bytecode.OpHalt, nil}
+	for i, tt := range []struct {
+		ops      []op
+		expected Value
+		err      error
+	}{
+		{[]op{f(1.5), f(2.25), {bytecode.OpAdd, nil}, halt}, Float64{ValueFloat64, 3.75}, nil},
+		{[]op{f(1.5), f(2.25), {bytecode.OpSub, nil}, halt}, Float64{ValueFloat64, -0.75}, nil},
+		{[]op{f(1.5), f(4), {bytecode.OpMul, nil}, halt}, Float64{ValueFloat64, 6}, nil},
+		{[]op{f(7), f(2), {bytecode.OpDiv, nil}, halt}, Float64{ValueFloat64, 3.5}, nil},
+		{[]op{f(7.5), f(2), {bytecode.OpMod, nil}, halt}, Float64{ValueFloat64, 1.5}, nil},
+		{[]op{f(1), f(0), {bytecode.OpDiv, nil}, halt}, Float64{ValueFloat64, math.Inf(1)}, nil},
+		{[]op{f(0.5), {bytecode.OpInc, nil}, halt}, Float64{ValueFloat64, 1.5}, nil},
+		{[]op{f(-2.75), {bytecode.OpToInt64, nil}, halt}, Int64{ValueInt64, -2}, nil},
+		{[]op{{bytecode.OpPushInt64, int64(-3)}, {bytecode.OpToFloat64, nil}, halt}, Float64{ValueFloat64, -3}, nil},
+		{[]op{{bytecode.OpPushUint8, uint8(200)}, {bytecode.OpToFloat64, nil}, halt}, Float64{ValueFloat64, 200}, nil},
+		{[]op{f(1), f(2), {bytecode.OpJumpLT, int64(30)}, f(0), halt, f(9), halt}, Float64{ValueFloat64, 9}, nil},
+		{[]op{f(2.5), f(2.5), {bytecode.OpJumpEq, int64(30)}, f(0), halt, f(9), halt}, Float64{ValueFloat64, 9}, nil},
+		{[]op{f(0), {bytecode.OpJumpFalse, int64(21)}, f(0), halt, f(9), halt}, Float64{ValueFloat64, 9}, nil},
+		{[]op{f(1), {bytecode.OpPushInt64, int64(1)}, {bytecode.OpAdd, nil}, halt}, Float64{ValueFloat64, 2}, nil},
+		{[]op{f(1), {bytecode.OpPushOne, nil}, {bytecode.OpCreateArray, nil}, {bytecode.OpAdd, nil}, halt}, nil, errors.New("add at 0011: expecting number operand, got array")},
+		{[]op{f(1e300), {bytecode.OpToInt64, nil}, halt}, nil, errors.New("unable to convert float64 to int64: out of range")},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, tt.ops...)
+		err := m.Exec()
+		if tt.err != nil {
+			if err == nil || !strings.Contains(err.Error(), tt.err.Error()) {
+				t.Errorf("%d. expecting error %v, got %v", i, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error: %v", i, err)
+			continue
+		}
+		if v, _ := m.Stack.Peek(); v != tt.expected {
+			t.Errorf("%d. expecting %#v on top of stack, got %#v", i, tt.expected, v)
+		}
+	}
+
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t, f(math.NaN()), f(math.NaN()), op{bytecode.OpJumpEq, int64(21)}, op{bytecode.OpPushZero, nil}, halt)
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Stack.Peek(); v != (Int64{ValueInt64, 0}) {
+		t.Errorf("expecting NaN to compare unequal to itself, got %v", v)
+	}
+}
+
+func TestUint64(t *testing.T) {
+	u := func(n uint64) op { return op{bytecode.OpPushUint64, n} }
+	i := func(n int64) op { return op{bytecode.OpPushInt64, n} }
+	halt := op{bytecode.OpHalt, nil}
+	for n, tt := range []struct {
+		ops      []op
+		expected Value
+		err      string
+	}{
+		{[]op{u(math.MaxUint64), u(2), {bytecode.OpAdd, nil}, halt}, Uint64{ValueUint64, 1}, ""},
+		{[]op{u(1), u(2), {bytecode.OpSub, nil}, halt}, Uint64{ValueUint64, math.MaxUint64}, ""},
+		{[]op{u(1 << 63), u(3), {bytecode.OpMul, nil}, halt}, Uint64{ValueUint64, 1 << 63}, ""},
+		{[]op{u(math.MaxUint64), u(10), {bytecode.OpDiv, nil}, halt}, Uint64{ValueUint64, math.MaxUint64 / 10}, ""},
+		{[]op{u(17), u(5), {bytecode.OpMod, nil}, halt}, Uint64{ValueUint64, 2}, ""},
+		{[]op{u(math.MaxUint64), {bytecode.OpInc, nil}, halt}, Uint64{ValueUint64, 0}, ""},
+		{[]op{u(0), {bytecode.OpDec, nil}, halt}, Uint64{ValueUint64, math.MaxUint64}, ""},
+		{[]op{u(0xf0), u(0x3c), {bytecode.OpXOR, nil}, halt}, Uint64{ValueUint64, 0xcc}, ""},
+		{[]op{u(0xf0), u(0x3c), {bytecode.OpAnd, nil}, halt}, Uint64{ValueUint64, 0x30}, ""},
+		{[]op{u(0xf0), u(0x3c), {bytecode.OpOr, nil}, halt}, Uint64{ValueUint64, 0xfc}, ""},
+		{[]op{u(0), {bytecode.OpNot, nil}, halt}, Uint64{ValueUint64, math.MaxUint64}, ""},
+		{[]op{u(1), i(63), {bytecode.OpShl, nil}, halt}, Uint64{ValueUint64, 1 << 63}, ""},
+		{[]op{u(1 << 63), {bytecode.OpPushUint8, uint8(63)}, {bytecode.OpShr, nil}, halt}, Uint64{ValueUint64, 1}, ""},
+		{[]op{u(1), u(64), {bytecode.OpShl, nil}, halt}, Uint64{ValueUint64, 0}, ""},
+		{[]op{i(-8), i(1), {bytecode.OpShr, nil}, halt}, Int64{ValueInt64, -4}, ""},
+		{[]op{{bytecode.OpPushUint8, uint8(0x81)}, i(1), {bytecode.OpShl, nil}, halt}, Uint8{ValueUint8, 0x02}, ""},
+		{[]op{u(1), i(-1), {bytecode.OpShl, nil}, halt}, nil, "negative shift count"},
+		{[]op{{bytecode.OpPushFloat64, 1.0}, i(1), {bytecode.OpShl, nil}, halt}, nil, "shl at 0011: expecting integer operand, got float64"},
+		{[]op{i(42), {bytecode.OpToUint64, nil}, halt}, Uint64{ValueUint64, 42}, ""},
+		{[]op{{bytecode.OpPushUint8, uint8(7)}, {bytecode.OpToUint64, nil}, halt}, Uint64{ValueUint64, 7}, ""},
+		{[]op{{bytecode.OpPushFloat64, 1e19}, {bytecode.OpToUint64, nil}, halt}, Uint64{ValueUint64, 1e19}, ""},
+		{[]op{i(-1), {bytecode.OpToUint64, nil}, halt}, nil, "unable to convert int64 to uint64: negative"},
+		{[]op{{bytecode.OpPushFloat64, -1.0}, {bytecode.OpToUint64, nil}, halt}, nil, "unable to convert float64 to uint64: out of range"},
+		{[]op{u(math.MaxInt64), {bytecode.OpToInt64, nil}, halt}, Int64{ValueInt64, math.MaxInt64}, ""},
+		{[]op{u(1 << 63), {bytecode.OpToInt64, nil}, halt}, nil, "unable to convert uint64 to int64: out of range"},
+		{[]op{u(255), {bytecode.OpToUint8, nil}, halt}, Uint8{ValueUint8, 255}, ""},
+		{[]op{u(256), {bytecode.OpToUint8, nil}, halt}, nil, "unable to convert uint64 to uint8: outside of range: 0-255"},
+		{[]op{u(1 << 53), {bytecode.OpToFloat64, nil}, halt}, Float64{ValueFloat64, 1 << 53}, ""},
+		{[]op{u(1), u(math.MaxUint64), {bytecode.OpJumpLT, int64(18)}, i(0), halt, i(9), halt}, Int64{ValueInt64, 9}, ""},
+		{[]op{u(7), u(7), {bytecode.OpJumpEq, int64(9)}, i(0), halt, i(9), halt}, Int64{ValueInt64, 9}, ""},
+		{[]op{u(0), {bytecode.OpJumpFalse, int64(7)}, i(0), halt, i(9), halt}, Int64{ValueInt64, 9}, ""},
+		{[]op{u(1), i(-2), {bytecode.OpAdd, nil}, halt}, Uint64{ValueUint64, math.MaxUint64}, ""},
+		{[]op{u(1), u(0), {bytecode.OpDiv, nil}, halt}, nil, ErrDivideByZero.Error()},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, tt.ops...)
+		err := m.Exec()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%d. expecting error %q, got %v", n, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error: %v", n, err)
+			continue
+		}
+		if v, _ := m.Stack.Peek(); v != tt.expected {
+			t.Errorf("%d. expecting %#v on top of stack, got %#v", n, tt.expected, v)
+		}
+	}
+}
+
+// push returns the instruction pushing the number v.
+func push(v Value) op {
+	switch v := v.(type) {
+	case Uint8:
+		return op{bytecode.OpPushUint8, v.Val}
+	case Int64:
+		return op{bytecode.OpPushInt64, v.Val}
+	case Uint64:
+		return op{bytecode.OpPushUint64, v.Val}
+	case Float64:
+		return op{bytecode.OpPushFloat64, v.Val}
+	}
+	panic("not a number")
+}
+
+func TestConversions(t *testing.T) {
+	u8 := op{bytecode.OpPushUint8, uint8(200)}
+	i64 := func(n int64) op { return op{bytecode.OpPushInt64, n} }
+	u64 := func(n uint64) op { return op{bytecode.OpPushUint64, n} }
+	f64 := func(f float64) op { return op{bytecode.OpPushFloat64, f} }
+	for n, tt := range []struct {
+		push     op
+		conv     byte
+		expected Value
+		err      string
+	}{
+		{u8, bytecode.OpToUint8, Uint8{ValueUint8, 200}, ""},
+		{u8, bytecode.OpToInt64, Int64{ValueInt64, 200}, ""},
+		{u8, bytecode.OpToUint64, Uint64{ValueUint64, 200}, ""},
+		{u8, bytecode.OpToFloat64, Float64{ValueFloat64, 200}, ""},
+
+		{i64(7), bytecode.OpToUint8, Uint8{ValueUint8, 7}, ""},
+		{i64(256), bytecode.OpToUint8, nil, "unable to convert int64 to uint8"},
+		{i64(-1), bytecode.OpToUint8, nil, "unable to convert int64 to uint8"},
+		{i64(-7), bytecode.OpToInt64, Int64{ValueInt64, -7}, ""},
+		{i64(7), bytecode.OpToUint64, Uint64{ValueUint64, 7}, ""},
+		{i64(-1), bytecode.OpToUint64, nil, "unable to convert int64 to uint64"},
+		{i64(-7), bytecode.OpToFloat64, Float64{ValueFloat64, -7}, ""},
+
+		{u64(255), bytecode.OpToUint8, Uint8{ValueUint8, 255}, ""},
+		{u64(256), bytecode.OpToUint8, nil, "unable to convert uint64 to uint8"},
+		{u64(math.MaxInt64), bytecode.OpToInt64, Int64{ValueInt64, math.MaxInt64}, ""},
+		{u64(math.MaxInt64 + 1), bytecode.OpToInt64, nil, "unable to convert uint64 to int64"},
+		{u64(math.MaxUint64), bytecode.OpToUint64, Uint64{ValueUint64, math.MaxUint64}, ""},
+		{u64(1 << 60), bytecode.OpToFloat64, Float64{ValueFloat64, 1 << 60}, ""},
+
+		{f64(255.9), bytecode.OpToUint8, Uint8{ValueUint8, 255}, ""},
+		{f64(256), bytecode.OpToUint8, nil, "unable to convert float64 to uint8"},
+		{f64(-0.5), bytecode.OpToUint8, nil, "unable to convert float64 to uint8"},
+		{f64(math.NaN()), bytecode.OpToUint8, nil, "unable to convert float64 to uint8"},
+		{f64(-2.9), bytecode.OpToInt64, Int64{ValueInt64, -2}, ""},
+		{f64(1 << 63), bytecode.OpToInt64, nil, "unable to convert float64 to int64"},
+		{f64(2.9), bytecode.OpToUint64, Uint64{ValueUint64, 2}, ""},
+		{f64(-1), bytecode.OpToUint64, nil, "unable to convert float64 to uint64"},
+		{f64(2.5), bytecode.OpToFloat64, Float64{ValueFloat64, 2.5}, ""},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, tt.push, op{tt.conv, nil}, op{bytecode.OpHalt, nil})
+		err := m.Exec()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%d. expecting error %q, got %v", n, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %v", n, err)
+			continue
+		}
+		if v, _ := m.Stack.Peek(); v != tt.expected {
+			t.Errorf("%d. expecting %s %v, got %s %v", n, typeName(tt.expected.Type()), tt.expected, typeName(v.Type()), v)
+		}
+	}
+}
+
+func TestNumericPromotion(t *testing.T) {
+	u8 := func(n uint8) Value { return Uint8{ValueUint8, n} }
+	i64 := func(n int64) Value { return Int64{ValueInt64, n} }
+	u64 := func(n uint64) Value { return Uint64{ValueUint64, n} }
+	f64 := func(f float64) Value { return Float64{ValueFloat64, f} }
+	// Every pair of operand types, each operand 7 or 2, and the type
+	// their result is promoted to.
+	pairs := []struct {
+		a, b Value
+		typ  ValueType
+	}{
+		{u8(7), u8(2), ValueUint8},
+		{u8(7), i64(2), ValueInt64},
+		{u8(7), u64(2), ValueUint64},
+		{u8(7), f64(2), ValueFloat64},
+		{i64(7), u8(2), ValueInt64},
+		{i64(7), i64(2), ValueInt64},
+		{i64(7), u64(2), ValueUint64},
+		{i64(7), f64(2), ValueFloat64},
+		{u64(7), u8(2), ValueUint64},
+		{u64(7), i64(2), ValueUint64},
+		{u64(7), u64(2), ValueUint64},
+		{u64(7), f64(2), ValueFloat64},
+		{f64(7), u8(2), ValueFloat64},
+		{f64(7), i64(2), ValueFloat64},
+		{f64(7), u64(2), ValueFloat64},
+		{f64(7), f64(2), ValueFloat64},
+	}
+	ops := []struct {
+		code  byte
+		ints  uint64  // result of 7 op 2 for integers
+		float float64 // result of 7 op 2 for floats, or NaN if floats are refused
+	}{
+		{bytecode.OpAdd, 9, 9},
+		{bytecode.OpSub, 5, 5},
+		{bytecode.OpMul, 14, 14},
+		{bytecode.OpDiv, 3, 3.5},
+		{bytecode.OpMod, 1, 1},
+		{bytecode.OpAnd, 2, math.NaN()},
+		{bytecode.OpOr, 7, math.NaN()},
+		{bytecode.OpXOR, 5, math.NaN()},
+	}
+	for _, o := range ops {
+		name := opName(o.code)
+		for i, tt := range pairs {
+			var expected Value
+			switch tt.typ {
+			case ValueUint8:
+				expected = u8(uint8(o.ints))
+			case ValueInt64:
+				expected = i64(int64(o.ints))
+			case ValueUint64:
+				expected = u64(o.ints)
+			case ValueFloat64:
+				if !math.IsNaN(o.float) {
+					expected = f64(o.float)
+				}
+			}
+			m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+			m.Instructions = program(t, push(tt.a), push(tt.b), op{o.code, nil}, op{bytecode.OpHalt, nil})
+			err := m.Exec()
+			if expected == nil {
+				var te *TypeError
+				if !errors.As(err, &te) || te.Op != name {
+					t.Errorf("%s %d. expecting %s TypeError for %v and %v, got %v", name, i, name, tt.a, tt.b, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s %d. unexpected error: %v", name, i, err)
+				continue
+			}
+			if v, _ := m.Stack.Peek(); v != expected {
+				t.Errorf("%s %d. expecting %#v, got %#v", name, i, expected, v)
+			}
+		}
+	}
+}
+
+func TestNumericOverflow(t *testing.T) {
+	halt := op{bytecode.OpHalt, nil}
+	for i, tt := range []struct {
+		ops      []op
+		expected Value
+		err      error
+	}{
+		{[]op{push(Uint8{ValueUint8, 255}), push(Uint8{ValueUint8, 1}), {bytecode.OpAdd, nil}, halt}, Uint8{ValueUint8, 0}, nil},
+		{[]op{push(Uint8{ValueUint8, 0}), push(Uint8{ValueUint8, 1}), {bytecode.OpSub, nil}, halt}, Uint8{ValueUint8, 255}, nil},
+		{[]op{push(Uint8{ValueUint8, 16}), push(Uint8{ValueUint8, 17}), {bytecode.OpMul, nil}, halt}, Uint8{ValueUint8, 16}, nil},
+		{[]op{push(Uint8{ValueUint8, 255}), {bytecode.OpInc, nil}, halt}, Uint8{ValueUint8, 0}, nil},
+		{[]op{push(Uint8{ValueUint8, 0}), {bytecode.OpDec, nil}, halt}, Uint8{ValueUint8, 255}, nil},
+		{[]op{push(Uint8{ValueUint8, 200}), push(Int64{ValueInt64, 100}), {bytecode.OpAdd, nil}, halt}, Int64{ValueInt64, 300}, nil},
+		{[]op{push(Int64{ValueInt64, math.MaxInt64}), push(Int64{ValueInt64, 1}), {bytecode.OpAdd, nil}, halt}, Int64{ValueInt64, math.MinInt64}, nil},
+		{[]op{push(Int64{ValueInt64, math.MaxInt64}), {bytecode.OpInc, nil}, halt}, Int64{ValueInt64, math.MinInt64}, nil},
+		{[]op{push(Int64{ValueInt64, math.MinInt64}), push(Int64{ValueInt64, -1}), {bytecode.OpDiv, nil}, halt}, Int64{ValueInt64, math.MinInt64}, nil},
+		{[]op{push(Int64{ValueInt64, -1}), push(Uint64{ValueUint64, 0}), {bytecode.OpAdd, nil}, halt}, Uint64{ValueUint64, math.MaxUint64}, nil},
+		{[]op{push(Int64{ValueInt64, -1}), push(Uint8{ValueUint8, 0xf0}), {bytecode.OpAnd, nil}, halt}, Int64{ValueInt64, 0xf0}, nil},
+		{[]op{push(Uint64{ValueUint64, 1 << 53}), push(Float64{ValueFloat64, 1}), {bytecode.OpAdd, nil}, halt}, Float64{ValueFloat64, 1 << 53}, nil},
+		{[]op{push(Float64{ValueFloat64, -1}), push(Uint8{ValueUint8, 0}), {bytecode.OpDiv, nil}, halt}, Float64{ValueFloat64, math.Inf(-1)}, nil},
+		{[]op{push(Uint8{ValueUint8, 1}), push(Uint8{ValueUint8, 0}), {bytecode.OpDiv, nil}, halt}, nil, ErrDivideByZero},
+		{[]op{push(Uint8{ValueUint8, 1}), push(Int64{ValueInt64, 0}), {bytecode.OpMod, nil}, halt}, nil, ErrDivideByZero},
+		{[]op{push(Int64{ValueInt64, 1}), push(Uint64{ValueUint64, 0}), {bytecode.OpDiv, nil}, halt}, nil, ErrDivideByZero},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, tt.ops...)
+		err := m.Exec()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%d. expecting error %v, got %v", i, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if v, _ := m.Stack.Peek(); v != tt.expected {
+			t.Errorf("%d. expecting %#v on top of stack, got %#v", i, tt.expected, v)
+		}
+	}
+}
+
+func TestNumericCompare(t *testing.T) {
+	u8 := func(n uint8) Value { return Uint8{ValueUint8, n} }
+	i64 := func(n int64) Value { return Int64{ValueInt64, n} }
+	u64 := func(n uint64) Value { return Uint64{ValueUint64, n} }
+	f64 := func(f float64) Value { return Float64{ValueFloat64, f} }
+	// Every pair of types with the operands less than, equal to and greater
+	// than one another, then edge cases. expected is the result of Compare.
+	for i, tt := range []struct {
+		a, b     Value
+		expected int
+	}{
+		{u8(1), u8(2), -1}, {u8(2), u8(2), 0}, {u8(3), u8(2), 1},
+		{u8(1), i64(2), -1}, {u8(2), i64(2), 0}, {u8(3), i64(2), 1},
+		{u8(1), u64(2), -1}, {u8(2), u64(2), 0}, {u8(3), u64(2), 1},
+		{u8(1), f64(2), -1}, {u8(2), f64(2), 0}, {u8(3), f64(2), 1},
+		{i64(1), u8(2), -1}, {i64(2), u8(2), 0}, {i64(3), u8(2), 1},
+		{i64(1), i64(2), -1}, {i64(2), i64(2), 0}, {i64(3), i64(2), 1},
+		{i64(1), u64(2), -1}, {i64(2), u64(2), 0}, {i64(3), u64(2), 1},
+		{i64(1), f64(2), -1}, {i64(2), f64(2), 0}, {i64(3), f64(2), 1},
+		{u64(1), u8(2), -1}, {u64(2), u8(2), 0}, {u64(3), u8(2), 1},
+		{u64(1), i64(2), -1}, {u64(2), i64(2), 0}, {u64(3), i64(2), 1},
+		{u64(1), u64(2), -1}, {u64(2), u64(2), 0}, {u64(3), u64(2), 1},
+		{u64(1), f64(2), -1}, {u64(2), f64(2), 0}, {u64(3), f64(2), 1},
+		{f64(1), u8(2), -1}, {f64(2), u8(2), 0}, {f64(3), u8(2), 1},
+		{f64(1), i64(2), -1}, {f64(2), i64(2), 0}, {f64(3), i64(2), 1},
+		{f64(1), u64(2), -1}, {f64(2), u64(2), 0}, {f64(3), u64(2), 1},
+		{f64(1), f64(2), -1}, {f64(2), f64(2), 0}, {f64(3), f64(2), 1},
+
+		{i64(-1), u64(math.MaxUint64), -1},
+		{u64(math.MaxUint64), i64(-1), 1},
+		{i64(-1), u8(255), -1},
+		{u64(math.MaxUint64), f64(1 << 64), -1},
+		{i64(1<<53 + 1), f64(1 << 53), 1},
+		{i64(math.MinInt64), f64(-(1 << 63)), 0},
+		{i64(math.MaxInt64), f64(1 << 63), -1},
+		{i64(2), f64(2.5), -1},
+		{i64(-2), f64(-2.5), 1},
+		{u64(0), f64(-0.5), 1},
+		{f64(math.Inf(-1)), i64(math.MinInt64), -1},
+		{f64(math.NaN()), i64(0), 2},
+		{i64(0), f64(math.NaN()), 2},
+		{f64(math.NaN()), f64(math.NaN()), 2},
+	} {
+		if c := tt.a.(Comparable).Compare(tt.b); c != tt.expected {
+			t.Errorf("%d. expecting %v compared with %v to be %d, got %d", i, tt.a, tt.b, tt.expected, c)
+		}
+		type equaler interface{ Equal(Value) bool }
+		if eq := tt.a.(equaler).Equal(tt.b); eq != (tt.expected == 0) {
+			t.Errorf("%d. expecting %v equal to %v to be %t", i, tt.a, tt.b, !eq)
+		}
+		for _, jump := range []struct {
+			code  byte
+			taken bool
+		}{
+			{bytecode.OpJumpEq, tt.expected == 0},
+			{bytecode.OpJumpNotEq, tt.expected != 0},
+			{bytecode.OpJumpLT, tt.expected == -1},
+			{bytecode.OpJumpGT, tt.expected == 1},
+		} {
+			prefix := program(t, push(tt.a), push(tt.b))
+			// jump, push_zero and halt, then push_one at the target.
+			target := int64(len(prefix) + 4)
+			m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+			m.Instructions = append(prefix, program(t,
+				op{jump.code, target}, op{bytecode.OpPushZero, nil}, op{bytecode.OpHalt, nil},
+				op{bytecode.OpPushOne, nil}, op{bytecode.OpHalt, nil})...)
+			if err := m.Exec(); err != nil {
+				t.Errorf("%d. %s: unexpected error: %v", i, opName(jump.code), err)
+				continue
+			}
+			if v, _ := m.Stack.Peek(); v != boolValue(jump.taken) {
+				t.Errorf("%d. expecting %s %v %v taken to be %t", i, opName(jump.code), tt.a, tt.b, jump.taken)
+			}
+		}
+	}
+
+	src := `
+var a
+:main
+	push_int64 2
+	create_array
+	dup
+	store a
+	load a
+	jump_eq same
+	push_zero
+	halt
+:same
+	push_int64 2
+	create_array
+	load a
+	jump_eq equal
+	push_zero
+	halt
+:equal
+	load a
+	push_one
+	jump_eq bad
+	load a
+	push_one
+	jump_lt bad
+	halt
+:bad
+	push_zero
+	halt
+`
+	img, err := asm.Assemble(strings.NewReader(src), asm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var te *TypeError
+	if err := m.Exec(); !errors.As(err, &te) || te.Op != "jump_lt" || te.Got != ValueArray {
+		t.Errorf("expecting jump_lt TypeError for an array, got %v with stack %v", err, m.Stack.Values())
+	}
+}
+
+func TestArrayEqual(t *testing.T) {
+	array := func(vs ...Value) *Array {
+		a := NewArray(0)
+		for _, v := range vs {
+			a.Append(v)
+		}
+		return a
+	}
+	self := array(Int64{ValueInt64, 1}, nil)
+	self.Set(1, self)
+	other := array(Uint8{ValueUint8, 1}, nil)
+	other.Set(1, other)
+	for i, tt := range []struct {
+		a, b     Value
+		expected bool
+	}{
+		{array(Int64{ValueInt64, 1}, Uint8{ValueUint8, 2}), array(Uint8{ValueUint8, 1}, Float64{ValueFloat64, 2}), true},
+		{array(Int64{ValueInt64, 1}), array(Uint64{ValueUint64, 1}), true},
+		{array(Int64{ValueInt64, -1}), array(Uint64{ValueUint64, math.MaxUint64}), false},
+		{array(Int64{ValueInt64, 1}, Int64{ValueInt64, 2}), array(Int64{ValueInt64, 1}, Int64{ValueInt64, 3}), false},
+		{array(Int64{ValueInt64, 1}), array(Int64{ValueInt64, 1}, Int64{ValueInt64, 1}), false},
+		{array(Float64{ValueFloat64, math.NaN()}), array(Float64{ValueFloat64, math.NaN()}), false},
+		{array(array(Uint8{ValueUint8, 7})), array(array(Float64{ValueFloat64, 7})), true},
+		{array(), Int64{ValueInt64, 0}, false},
+		{self, other, true},
+	} {
+		if eq := tt.a.(interface{ Equal(Value) bool }).Equal(tt.b); eq != tt.expected {
+			t.Errorf("%d. expecting %v equal to %v to be %t", i, tt.a, tt.b, tt.expected)
+		}
+	}
+
+	src := `
+var text "AB"
+var codes 65, 66.0
+:main
+	load text
+	load codes
+	jump_eq same
+	push_zero
+	halt
+:same
+	push_one
+	halt
+`
+	img, err := asm.Assemble(strings.NewReader(src), asm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Stack.Peek(); v != (Int64{ValueInt64, 1}) {
+		t.Errorf("expecting jump_eq to find a uint8 array equal to a mixed int64 and float64 one")
+	}
+}
+
+func TestTypeError(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t,
+		op{bytecode.OpPushZero, nil}, op{bytecode.OpPushZero, nil}, op{bytecode.OpArrayLoad, nil}, op{bytecode.OpHalt, nil},
+	)
+	var te *TypeError
+	if err := m.Exec(); !errors.As(err, &te) || te.Op != "array_load" {
+		t.Errorf("expecting array_load TypeError, got %v", err)
+	}
+
+	m = NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t, op{bytecode.OpPushOne, nil}, op{bytecode.OpCreateArray, nil}, op{bytecode.OpPrintStr, nil}, op{bytecode.OpHalt, nil})
+	if err := m.Exec(); !errors.As(err, &te) || te.Op != "print_str" || te.Got != ValueInt64 {
+		t.Errorf("expecting print_str TypeError for an int64 element, got %v", err)
+	}
+
+	array := []op{{bytecode.OpPushOne, nil}, {bytecode.OpCreateArray, nil}}
+	for i, tt := range []struct {
+		ops []op
+		op  string
+		got ValueType
+	}{
+		{append(array, op{bytecode.OpPushOne, nil}, op{bytecode.OpAdd, nil}), "add", ValueArray},
+		{append([]op{{bytecode.OpPushOne, nil}}, append(array, op{bytecode.OpMod, nil})...), "mod", ValueArray},
+		{append(array, op{bytecode.OpPushOne, nil}, op{bytecode.OpJumpGT, int64(0)}), "jump_gt", ValueArray},
+		{append(array, op{bytecode.OpInc, nil}), "inc", ValueArray},
+		{append(array, op{bytecode.OpDec, nil}), "dec", ValueArray},
+		{append(array, op{bytecode.OpToUint8, nil}), "to_uint8", ValueArray},
+		{append(array, op{bytecode.OpToInt64, nil}), "to_int64", ValueArray},
+		{[]op{{bytecode.OpPushOne, nil}, {bytecode.OpPrintCh, nil}}, "print_ch", ValueInt64},
+		{[]op{{bytecode.OpPushFloat64, 1.0}, {bytecode.OpPushOne, nil}, {bytecode.OpXOR, nil}}, "xor", ValueFloat64},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, append(tt.ops, op{bytecode.OpHalt, nil})...)
+		var te *TypeError
+		if err := m.Exec(); !errors.As(err, &te) || te.Op != tt.op || te.Got != tt.got {
+			t.Errorf("%d. expecting %s TypeError for %s, got %v", i, tt.op, typeName(tt.got), err)
+		}
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	// 0: call 3; 2: halt; 3: push_one; 4: push_zero; 5: div; 6: ret
+	m.Instructions = program(t,
+		op{bytecode.OpCall, int64(3)}, op{bytecode.OpHalt, nil},
+		op{bytecode.OpPushOne, nil}, op{bytecode.OpPushZero, nil}, op{bytecode.OpDiv, nil}, op{bytecode.OpRet, nil},
+	)
+	err := m.Exec()
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expecting RuntimeError, got %v", err)
+	}
+	if rerr.IP != 5 || rerr.Op != "div" || !errors.Is(err, ErrDivideByZero) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(rerr.CallStack) != 1 || rerr.CallStack[0] != 2 {
+		t.Errorf("expecting call stack [2], got %v", rerr.CallStack)
+	}
+}
+
+func TestArrayString(t *testing.T) {
+	// push_int64 3; create_array; dup; dup; push_zero; swap; array_store; print
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t,
+		op{bytecode.OpPushInt64, int64(3)}, op{bytecode.OpCreateArray, nil},
+		op{bytecode.OpDup, nil}, op{bytecode.OpDup, nil}, op{bytecode.OpPushZero, nil}, op{bytecode.OpSwap, nil},
+		op{bytecode.OpArrayStore, nil}, op{bytecode.OpPrint, nil}, op{bytecode.OpHalt, nil},
+	)
+	var buf bytes.Buffer
+	m.Stdout = &buf
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[[...] 0 0]"; buf.String() != expected {
+		t.Errorf("expecting %q, got %q", expected, buf.String())
+	}
+
+	inner := NewArray(1)
+	outer := NewArray(2)
+	outer.Set(0, inner)
+	outer.Set(1, inner)
+	if expected := "[[0] [0]]"; outer.String() != expected {
+		t.Errorf("expecting an array appearing twice but not inside itself to be written in full as %q, got %q", expected, outer.String())
+	}
+	inner.Set(0, outer)
+	if expected := "[[[...]] [[...]]]"; outer.String() != expected {
+		t.Errorf("expecting %q, got %q", expected, outer.String())
+	}
+
+	m = NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t, op{bytecode.OpPushOne, nil}, op{bytecode.OpCreateArray, nil},
+		op{bytecode.OpDup, nil}, op{bytecode.OpDup, nil}, op{bytecode.OpPushZero, nil}, op{bytecode.OpSwap, nil},
+		op{bytecode.OpArrayStore, nil}, op{bytecode.OpPushOne, nil}, op{bytecode.OpPushZero, nil}, op{bytecode.OpDiv, nil},
+		op{bytecode.OpHalt, nil},
+	)
+	var rerr *RuntimeError
+	if err := m.Exec(); !errors.As(err, &rerr) {
+		t.Fatalf("expecting RuntimeError, got %v", err)
+	}
+	if trace := rerr.Trace(); !strings.Contains(trace, "[[...]]") {
+		t.Errorf("expecting the stack snapshot to show the self-containing array, got:\n%s", trace)
+	}
+}
+
+func TestCallRet(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	// 0: call 4; 2: push_zero; 3: halt; 4: push_one; 5: ret
+	m.Instructions = program(t,
+		op{bytecode.OpCall, int64(4)}, op{bytecode.OpPushZero, nil}, op{bytecode.OpHalt, nil},
+		op{bytecode.OpPushOne, nil}, op{bytecode.OpRet, nil},
+	)
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Stack.Peek(); m.Stack.Len() != 2 || v != (Int64{ValueInt64, 0}) {
+		t.Errorf("unexpected stack after call/ret: %d values, top %v", m.Stack.Len(), v)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	src := `
+.func sub args=2
+	load_local 0
+	load_local 1
+	sub
+	ret
+.func fib args=1 locals=1
+	load_local 0
+	push_int64 2
+	jump_lt done
+	load_local 0
+	dec
+	call fib
+	store_local 1
+	load_local 0
+	push_int64 2
+	call sub
+	call fib
+	load_local 1
+	add
+	ret
+:done
+	load_local 0
+	ret
+.func main locals=1
+	push_int64 7
+	push_int64 10
+	call sub
+	store_local 0
+	push_int64 15
+	call fib
+	load_local 0
+	halt
+`
+	img, err := asm.Assemble(strings.NewReader(src), asm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Stack.Values(); !reflect.DeepEqual(got, []Value{Int64{ValueInt64, 610}, Int64{ValueInt64, -3}}) {
+		t.Errorf("expecting fib(15) and 7-10 on the stack, got %v", got)
+	}
+
+	for i, tt := range []struct {
+		ops []op
+		err error
+	}{
+		{[]op{{bytecode.OpLoadLocal, int64(0)}, {bytecode.OpHalt, nil}}, ErrInvalidLocal},
+		{[]op{{bytecode.OpEnter, [2]int64{0, 2}}, {bytecode.OpPushOne, nil}, {bytecode.OpStoreLocal, int64(2)}, {bytecode.OpHalt, nil}}, ErrInvalidLocal},
+		{[]op{{bytecode.OpEnter, [2]int64{0, maxLocals + 1}}, {bytecode.OpHalt, nil}}, ErrInvalidLocal},
+		{[]op{{bytecode.OpCall, int64(3)}, {bytecode.OpHalt, nil}, {bytecode.OpEnter, [2]int64{1, 0}}, {bytecode.OpRet, nil}}, ErrStackUnderflow},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, tt.ops...)
+		if err := m.Exec(); !errors.Is(err, tt.err) {
+			t.Errorf("%d. expecting error %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestStackBounds(t *testing.T) {
+	for i, tt := range []struct {
+		ops []op
+		err error
+	}{
+		{[]op{{bytecode.OpDrop, nil}}, ErrStackUnderflow},
+		{[]op{{bytecode.OpPushOne, nil}, {bytecode.OpAdd, nil}}, ErrStackUnderflow},
+		{[]op{{bytecode.OpPushOne, nil}, {bytecode.OpSwap, nil}}, ErrStackUnderflow},
+		{[]op{{bytecode.OpDup, nil}}, ErrStackUnderflow},
+		{[]op{{bytecode.OpRet, nil}}, ErrStackUnderflow},
+		{[]op{{bytecode.OpPushOne, nil}, {bytecode.OpJump, int64(0)}}, ErrStackOverflow},
+		{[]op{{bytecode.OpCall, int64(0)}, {bytecode.OpHalt, nil}}, ErrStackOverflow},
+		{[]op{{bytecode.OpCall, int64(3)}, {bytecode.OpHalt, nil}, {bytecode.OpDrop, nil}, {bytecode.OpRet, nil}}, ErrStackUnderflow},
+		{[]op{{bytecode.OpPushOne, nil}}, ErrIPOutOfRange},
+	} {
+		m := NewMachine(16, 16)
+		m.Instructions = program(t, tt.ops...)
+		if err := m.Exec(); !errors.Is(err, tt.err) {
+			t.Errorf("%d. expecting error %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for i, tt := range []struct {
+		code []byte
+		data int
+		err  error
+	}{
+		{program(t, op{bytecode.OpJump, int64(1)}, op{bytecode.OpHalt, nil}), 0, ErrInvalidTarget},
+		{program(t, op{bytecode.OpLoad, int64(1)}, op{bytecode.OpHalt, nil}), 1, ErrInvalidDataIndex},
+		{program(t, op{bytecode.OpMov, [2]int64{0, -1}}, op{bytecode.OpHalt, nil}), 1, ErrInvalidDataIndex},
+		{program(t, op{bytecode.OpPushOne, nil}, op{bytecode.OpAdd, nil}, op{bytecode.OpHalt, nil}), 0, ErrStackUnderflow},
+		{program(t, op{bytecode.OpPushOne, nil}), 0, ErrIPOutOfRange},
+		{[]byte{bytecode.OpPushInt64, 0x80}, 0, bytecode.ErrTruncated},
+		{[]byte{bytecode.OpLast}, 0, bytecode.ErrUnknownOp},
+		{program(t,
+			// depths differ where the branches meet, so the final add is left to run time
+			op{bytecode.OpPushOne, nil}, op{bytecode.OpJumpTrue, int64(5)}, op{bytecode.OpPushOne, nil},
+			op{bytecode.OpPushOne, nil}, op{bytecode.OpAdd, nil}, op{bytecode.OpHalt, nil},
+		), 0, nil},
+	} {
+		if err := Verify(tt.code, 0, tt.data); !errors.Is(err, tt.err) {
+			t.Errorf("%d. expecting error %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestExecLimits(t *testing.T) {
+	loop := program(t, op{bytecode.OpNOP, nil}, op{bytecode.OpJump, int64(0)})
+
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = loop
+	m.MaxSteps = 100
+	if err := m.Exec(); !errors.Is(err, ErrBudgetExhausted) || m.Steps != 100 {
+		t.Errorf("expecting budget to be exhausted after 100 steps, got %v after %d", err, m.Steps)
+	}
+
+	m = NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = loop
+	m.Deadline = time.Now().Add(10 * time.Millisecond)
+	if err := m.Exec(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expecting deadline to be exceeded, got %v", err)
+	}
+
+	m = NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = loop
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.ExecContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expecting context to be canceled, got %v", err)
+	}
+}
+
+func TestStepAndRun(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	// 0: push_one; 1: push_one; 2: add; 3: store 0; 5: halt
+	m.Instructions = program(t,
+		op{bytecode.OpPushOne, nil}, op{bytecode.OpPushOne, nil}, op{bytecode.OpAdd, nil},
+		op{bytecode.OpStore, int64(0)}, op{bytecode.OpHalt, nil},
+	)
+	m.Data = make([]Value, 1)
+	if err := m.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if m.State() != Paused || m.IP != 1 || m.Stack.Len() != 1 {
+		t.Errorf("after one step: state %d, IP %d, stack depth %d", m.State(), m.IP, m.Stack.Len())
+	}
+	if err := m.Run(2); err != nil {
+		t.Fatal(err)
+	}
+	if m.State() != Paused || m.IP != 3 || m.Stack.Len() != 1 {
+		t.Errorf("after three steps: state %d, IP %d, stack depth %d", m.State(), m.IP, m.Stack.Len())
+	}
+	if err := m.Run(10); err != nil {
+		t.Fatal(err)
+	}
+	if m.State() != Halted || m.Steps != 5 || m.Data[0] != (Int64{ValueInt64, 2}) {
+		t.Errorf("after halting: state %d, %d steps, data %v", m.State(), m.Steps, m.Data)
+	}
+	if err := m.Step(); err != ErrHalted {
+		t.Errorf("expecting ErrHalted stepping a halted machine, got %v", err)
+	}
+}
+
+func TestRuntimeErrorPosition(t *testing.T) {
+	src := "var n\n:main\n\tpush_one\n\tstore n\n\tload n\n\tpush_zero\n\tdiv\n\thalt\n"
+	img, err := asm.Assemble(strings.NewReader(src), asm.Options{File: "div.asm", Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Exec()
+	if err == nil || err.Error() != "div.asm:7 div: division by zero" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t, op{bytecode.OpPushInt64, int64(5)}, op{bytecode.OpDup, nil}, op{bytecode.OpHalt, nil})
+	var buf bytes.Buffer
+	m.Tracer = NewJSONTracer(&buf)
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	var records []TraceRecord
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r TraceRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expecting 3 trace records, got %d", len(records))
+	}
+	if r := records[2]; r.IP != 3 || r.Op != "halt" || r.Depth != 2 || !reflect.DeepEqual(r.Top, []string{"5", "5"}) {
+		t.Errorf("unexpected final record: %#v", r)
+	}
+
+	m = NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t, op{bytecode.OpPushOne, nil}, op{bytecode.OpHalt, nil})
+	buf.Reset()
+	m.Tracer = NewTextTracer(&buf)
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "     0 0000 push_one                 depth=0   []\n     1 0001 halt                     depth=1   [1]\n"; buf.String() != expected {
+		t.Errorf("expecting:\n%s\nreceived:\n%s", expected, buf.String())
+	}
+}
+
+func TestProfile(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t,
+		op{bytecode.OpCall, int64(3)},
+		op{bytecode.OpHalt, nil},
+		op{bytecode.OpPushOne, nil},
+		op{bytecode.OpDrop, nil},
+		op{bytecode.OpRet, nil},
+	)
+	m.Profile = NewProfile()
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[int]int64{0: 1, 2: 1, 3: 1, 4: 1, 5: 1}; !reflect.DeepEqual(m.Profile.Counts(), expected) {
+		t.Errorf("expecting counts %v, got %v", expected, m.Profile.Counts())
+	}
+	for _, s := range m.Profile.Samples() {
+		if s.Stack[0] >= 3 && !reflect.DeepEqual(s.Stack, []int{s.Stack[0], 2}) {
+			t.Errorf("expecting %04d to be attributed to the call returning to 0002, got %v", s.Stack[0], s.Stack)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t,
+		op{bytecode.OpPushInt64, int64(3)},
+		op{bytecode.OpDec, nil},
+		op{bytecode.OpDup, nil},
+		op{bytecode.OpJumpTrue, int64(2)},
+		op{bytecode.OpHalt, nil},
+	)
+	m.Coverage = NewCoverage()
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[int]int64{0: 1, 2: 3, 3: 3, 4: 3, 6: 1}; !reflect.DeepEqual(m.Coverage.Hits, expected) {
+		t.Errorf("expecting hits %v, got %v", expected, m.Coverage.Hits)
+	}
+	if b := m.Coverage.Branches[4]; b == nil || *b != (BranchCount{2, 1}) {
+		t.Errorf("expecting branch at 0004 taken 2, not taken 1, got %v", b)
+	}
+	if len(m.Coverage.Branches) != 1 {
+		t.Errorf("expecting a single conditional branch, got %v", m.Coverage.Branches)
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+func TestOutput(t *testing.T) {
+	m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t,
+		op{bytecode.OpPushInt64, int64(42)}, op{bytecode.OpPrint, nil},
+		op{bytecode.OpPushUint8, uint8('\n')}, op{bytecode.OpPrintCh, nil},
+		op{bytecode.OpHalt, nil},
+	)
+	var buf bytes.Buffer
+	m.Stdout = &buf
+	if err := m.Run(2); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "42" {
+		t.Errorf("expecting output to be flushed when the machine pauses, got %q", buf.String())
+	}
+	if err := m.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "42\n" {
+		t.Errorf("expecting %q, got %q", "42\n", buf.String())
+	}
+
+	errFull := errors.New("disk full")
+	m = NewMachine(DefaultStackSize, DefaultCallStackSize)
+	m.Instructions = program(t, op{bytecode.OpPushOne, nil}, op{bytecode.OpPrint, nil}, op{bytecode.OpHalt, nil})
+	m.Stdout = failingWriter{errFull}
+	err := m.Exec()
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) || !errors.Is(err, errFull) {
+		t.Fatalf("expecting a runtime error wrapping %v, got %v", errFull, err)
+	}
+	if rerr.Op != "halt" || m.State() != Failed {
+		t.Errorf("expecting the flush at halt to fail the machine, got %v in state %v", err, m.State())
+	}
+}
+
+func TestInput(t *testing.T) {
+	for i, tt := range []struct {
+		in       string
+		ops      []op
+		expected []string // the operand stack, bottom first
+		err      error
+	}{
+		{"ab", []op{{bytecode.OpReadByte, nil}, {bytecode.OpReadByte, nil}, {bytecode.OpReadByte, nil}}, []string{"97", "98", "-1"}, nil},
+		{" 12\n-7x", []op{{bytecode.OpReadInt, nil}, {bytecode.OpReadInt, nil}, {bytecode.OpReadByte, nil}}, []string{"12", "1", "-7", "1", "120"}, nil},
+		{"  \n", []op{{bytecode.OpReadInt, nil}}, []string{"0", "0"}, nil},
+		{" x", []op{{bytecode.OpReadInt, nil}, {bytecode.OpReadByte, nil}}, []string{"0", "0", "120"}, nil},
+		{"-x", []op{{bytecode.OpReadInt, nil}, {bytecode.OpReadLine, nil}}, []string{"0", "0", "[45 120]", "1"}, nil},
+		{"99999999999999999999 1", []op{{bytecode.OpReadInt, nil}, {bytecode.OpReadByte, nil}}, []string{"0", "0", "57"}, nil},
+		{"+", []op{{bytecode.OpReadInt, nil}, {bytecode.OpReadByte, nil}}, []string{"0", "0", "43"}, nil},
+		{"7", []op{{bytecode.OpReadInt, nil}, {bytecode.OpReadInt, nil}}, []string{"7", "1", "0", "0"}, nil},
+		{"hi\r\nyo", []op{{bytecode.OpReadLine, nil}, {bytecode.OpReadLine, nil}, {bytecode.OpReadLine, nil}}, []string{"[104 105]", "1", "[121 111]", "1", "[]", "0"}, nil},
+	} {
+		m := NewMachine(DefaultStackSize, DefaultCallStackSize)
+		m.Instructions = program(t, append(tt.ops, op{bytecode.OpHalt, nil})...)
+		m.Stdin = strings.NewReader(tt.in)
+		err := m.Exec()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%d. expecting error %v, got %v", i, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var stack []string
+		for _, v := range m.Stack.Values() {
+			stack = append(stack, fmt.Sprint(v))
+		}
+		if !reflect.DeepEqual(stack, tt.expected) {
+			t.Errorf("%d. expecting stack %v, got %v", i, tt.expected, stack)
+		}
+	}
+}